@@ -0,0 +1,37 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package tar
+
+import (
+	"context"
+	"io"
+
+	"github.com/coreos/rkt/pkg/user"
+)
+
+// execExtractTar returns ErrNotSupportedPlatform, the extracttar multicall
+// entrypoint is only available on Linux.
+func execExtractTar(rs io.Reader, dir string, overwrite bool, uidRange *user.UidRange, pwl PathWhitelistMap) error {
+	return ErrNotSupportedPlatform
+}
+
+// extractChroot returns ErrNotSupportedPlatform, chrooting a single thread
+// is only supported on Linux.
+func (e *Extractor) extractChroot(ctx context.Context, next nextTarball, dir string) error {
+	return ErrNotSupportedPlatform
+}
@@ -0,0 +1,236 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// The magics of the first block of a bzip2 stream, and of the end of an empty
+// stream, following the magic and the block size.
+var (
+	bzip2BlockMagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2EOSMagic   = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// ErrNoXzDecompressor is returned when reading an xz compressed stream
+// without an xz Decompressor set with SetXzDecompressor.
+var ErrNoXzDecompressor = errors.New("xz compressed stream but no xz decompressor set")
+
+// Decompressor returns a reader of the decompressed stream read from r. The
+// leading bytes identifying the compression are part of the stream read from
+// r.
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+// registeredDecompressor is a Decompressor registered with
+// RegisterDecompressor.
+type registeredDecompressor struct {
+	magic []byte
+	d     Decompressor
+	// check, if not nil, is called with the leading bytes of a stream
+	// starting with magic, to confirm its compression
+	check func(data []byte) bool
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = []registeredDecompressor{
+		{magic: gzipMagic, d: func(r io.Reader) (io.Reader, error) {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return gr, nil
+		}},
+		{magic: bzip2Magic, d: func(r io.Reader) (io.Reader, error) {
+			return bzip2.NewReader(r), nil
+		}, check: isBzip2},
+	}
+)
+
+// RegisterDecompressor registers the Decompressor used by DecompressingReader
+// for the streams starting with magic, replacing the one registered for the
+// same magic, if any. A nil Decompressor unregisters it. When the magics of
+// several Decompressors match, the longest one is used. Gzip and bzip2 are
+// registered by default. It panics if magic is empty.
+func RegisterDecompressor(magic []byte, d Decompressor) {
+	if len(magic) == 0 {
+		panic("tar: RegisterDecompressor with an empty magic")
+	}
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	for i, rd := range decompressors {
+		if !bytes.Equal(rd.magic, magic) {
+			continue
+		}
+		if d == nil {
+			decompressors = append(decompressors[:i], decompressors[i+1:]...)
+		} else {
+			decompressors[i].d = d
+		}
+		return
+	}
+	if d != nil {
+		magic = append([]byte(nil), magic...)
+		decompressors = append(decompressors, registeredDecompressor{magic: magic, d: d})
+	}
+}
+
+// SetXzDecompressor sets the Decompressor used by DecompressingReader for
+// xz compressed streams, like RegisterDecompressor. This package doesn't ship
+// an xz implementation, a caller can wire one, for example
+// github.com/ulikunitz/xz, with:
+//
+//	tar.SetXzDecompressor(func(r io.Reader) (io.Reader, error) {
+//		return xz.NewReader(r)
+//	})
+func SetXzDecompressor(d Decompressor) {
+	RegisterDecompressor(xzMagic, d)
+}
+
+// bzip2HeaderLen is the number of leading bytes checked by isBzip2.
+var bzip2HeaderLen = len(bzip2Magic) + 1 + len(bzip2BlockMagic)
+
+// isBzip2 returns whether data starts with the header of a bzip2 stream: the
+// magic, a block size between 1 and 9 and the magic of the first block, or
+// of the end of the stream if it's empty. The magic alone is too short to
+// tell a bzip2 stream from a tarball whose first entry name starts with it.
+func isBzip2(data []byte) bool {
+	if len(data) < bzip2HeaderLen || !bytes.HasPrefix(data, bzip2Magic) {
+		return false
+	}
+	if level := data[len(bzip2Magic)]; level < '1' || level > '9' {
+		return false
+	}
+	block := data[len(bzip2Magic)+1:]
+	return bytes.HasPrefix(block, bzip2BlockMagic) || bytes.HasPrefix(block, bzip2EOSMagic)
+}
+
+// lookupDecompressor returns the Decompressor registered with the longest
+// magic prefixing data, if any.
+func lookupDecompressor(data []byte) Decompressor {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	var d Decompressor
+	var matched int
+	for _, rd := range decompressors {
+		if len(rd.magic) <= matched || !bytes.HasPrefix(data, rd.magic) {
+			continue
+		}
+		if rd.check == nil || rd.check(data) {
+			d, matched = rd.d, len(rd.magic)
+		}
+	}
+	return d
+}
+
+// magicLen returns the number of leading bytes needed to detect the
+// compression of a stream.
+func magicLen() int {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	// Also detect xz without a Decompressor, and check the bzip2 header
+	n := len(xzMagic)
+	if bzip2HeaderLen > n {
+		n = bzip2HeaderLen
+	}
+	for _, rd := range decompressors {
+		if len(rd.magic) > n {
+			n = len(rd.magic)
+		}
+	}
+	return n
+}
+
+// DecompressingReader detects the compression of the stream read from r by
+// looking at its leading bytes and returns a reader of the decompressed
+// stream, with the Decompressor registered for them. Gzip and bzip2
+// compressed streams are supported by default, as well as xz compressed
+// streams if an xz Decompressor has been set with SetXzDecompressor.
+// Uncompressed streams are returned as they are.
+//
+// Gzip streams made of multiple concatenated members are read until the end
+// of the last one.
+func DecompressingReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(magicLen())
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if d := lookupDecompressor(magic); d != nil {
+		return d(br)
+	}
+	if bytes.HasPrefix(magic, xzMagic) {
+		return nil, ErrNoXzDecompressor
+	}
+	return br, nil
+}
+
+// ExtractTarGz extracts a possibly gzip compressed tarball read from r into
+// dir, see ExtractReader.
+func ExtractTarGz(r io.Reader, dir string, opts ...Option) error {
+	return ExtractReader(r, dir, opts...)
+}
+
+// ExtractTarBz2 extracts a possibly bzip2 compressed tarball read from r into
+// dir, see ExtractReader.
+func ExtractTarBz2(r io.Reader, dir string, opts ...Option) error {
+	return ExtractReader(r, dir, opts...)
+}
+
+// ExtractTarXz extracts a possibly xz compressed tarball read from r into
+// dir, see ExtractReader. An xz Decompressor must have been set with
+// SetXzDecompressor.
+func ExtractTarXz(r io.Reader, dir string, opts ...Option) error {
+	return ExtractReader(r, dir, opts...)
+}
+
+// ExtractReader extracts the tarball read from r into dir in the current
+// process, with an Extractor configured with the given options only, see
+// NewExtractor. Unlike with ExtractTarInsecure, the existing files are
+// replaced, the times of the entries aren't restored and the umask of the
+// process applies unless an option says otherwise. The tarball can be
+// compressed, see DecompressingReader.
+func ExtractReader(r io.Reader, dir string, opts ...Option) error {
+	dr, err := DecompressingReader(r)
+	if err != nil {
+		return err
+	}
+	e := NewExtractor(opts...)
+	if e.tee == nil {
+		return e.Extract(tar.NewReader(dr), dir)
+	}
+	dr = io.TeeReader(dr, e.tee)
+	if err := e.Extract(tar.NewReader(dr), dir); err != nil {
+		return err
+	}
+	// archive/tar stops reading at the end of the archive
+	_, err = io.Copy(ioutil.Discard, dr)
+	return err
+}
@@ -0,0 +1,362 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func compressionTestEntries() []*testTarEntry {
+	return []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+}
+
+func compressionTestExpectedFiles() map[string]*fileInfo {
+	return fileInfoSliceToMap([]*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "folder/bar.txt", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+	})
+}
+
+// gzipMembers returns the chunks compressed as concatenated gzip members.
+func gzipMembers(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(chunk); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTarGz(t *testing.T) {
+	data := readTestTar(t, compressionTestEntries())
+	half := len(data) / 2
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"uncompressed", data},
+		{"gzip", gzipMembers(t, data)},
+		{"multistream gzip", gzipMembers(t, data[:half], data[half:])},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractTarGz(bytes.NewReader(tt.data), tmpdir); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestExtractReader(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	data := readTestTar(t, compressionTestEntries())
+	if err := ExtractReader(bytes.NewReader(data), tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractReaderTee(t *testing.T) {
+	// Padded to a 10KiB record, like GNU tar does
+	data := readTestTar(t, compressionTestEntries())
+	data = append(data, make([]byte, 20*blockSize-len(data)%(20*blockSize))...)
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		extract func(r io.Reader, dir string, opts ...Option) error
+	}{
+		{"uncompressed", data, ExtractReader},
+		{"gzip", gzipMembers(t, data), ExtractTarGz},
+		{"concatenated", data, func(r io.Reader, dir string, opts ...Option) error {
+			return NewExtractor(opts...).ExtractConcatenated(context.Background(), r, dir)
+		}},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		var tee bytes.Buffer
+		if err := tt.extract(bytes.NewReader(tt.data), tmpdir, WithTee(&tee)); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !bytes.Equal(tee.Bytes(), data) {
+			t.Errorf("%s: the teed archive differs, %d bytes instead of %d", tt.name, tee.Len(), len(data))
+		}
+	}
+
+	// Write errors abort the extraction
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractReader(bytes.NewReader(data), tmpdir, WithTee(failingWriter{})); !errors.Is(err, errTeeFailed) {
+		t.Errorf("expected the write error, got: %v", err)
+	}
+}
+
+var errTeeFailed = errors.New("tee failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errTeeFailed }
+
+func TestRegisterDecompressor(t *testing.T) {
+	data := readTestTar(t, compressionTestEntries())
+	// A fake codec, prefixing the uncompressed stream with its magic
+	fake := func(magic string) Decompressor {
+		return func(r io.Reader) (io.Reader, error) {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(len(magic))); err != nil {
+				return nil, err
+			}
+			return r, nil
+		}
+	}
+	fakeZst := append([]byte("\x28\xb5\x2f\xfd"), data...)
+
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// Not registered, read as an uncompressed stream
+	if err := ExtractReader(bytes.NewReader(fakeZst), tmpdir); err == nil {
+		t.Fatalf("expected an error without the decompressor")
+	}
+
+	var used []string
+	RegisterDecompressor([]byte("\x28\xb5\x2f\xfd"), func(r io.Reader) (io.Reader, error) {
+		used = append(used, "zstd")
+		return fake("\x28\xb5\x2f\xfd")(r)
+	})
+	defer RegisterDecompressor([]byte("\x28\xb5\x2f\xfd"), nil)
+	// The longest magic wins over the gzip one
+	RegisterDecompressor([]byte("\x1f\x8bFAKE"), func(r io.Reader) (io.Reader, error) {
+		used = append(used, "fake")
+		return fake("\x1f\x8bFAKE")(r)
+	})
+	defer RegisterDecompressor([]byte("\x1f\x8bFAKE"), nil)
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		used []string
+	}{
+		{"zstd", fakeZst, []string{"zstd"}},
+		{"longest magic", append([]byte("\x1f\x8bFAKE"), data...), []string{"fake"}},
+		{"gzip", gzipMembers(t, data), nil},
+	} {
+		used = nil
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractReader(bytes.NewReader(tt.data), tmpdir); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if fmt.Sprint(used) != fmt.Sprint(tt.used) {
+			t.Errorf("%s: unexpected decompressors used: %v", tt.name, used)
+		}
+	}
+}
+
+func TestDecompressingReaderShortInput(t *testing.T) {
+	r, err := DecompressingReader(bytes.NewReader([]byte{0x1f}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x1f}) {
+		t.Errorf("unexpected data: %v", data)
+	}
+}
+
+// bzip2TestTar is a bzip2 compressed tarball containing folder/,
+// folder/foo.txt and folder/bar.txt
+var bzip2TestTar = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xee, 0x6d,
+	0x9c, 0x84, 0x00, 0x00, 0xb3, 0xfb, 0x80, 0xc9, 0x80, 0x00, 0x20, 0x40,
+	0x01, 0xff, 0x80, 0x10, 0x20, 0x77, 0x04, 0x9e, 0x40, 0x08, 0x18, 0x20,
+	0x00, 0x92, 0x86, 0x53, 0x51, 0xea, 0x1a, 0x00, 0x32, 0x34, 0x19, 0x34,
+	0x08, 0xa5, 0x27, 0xea, 0x4d, 0x1e, 0xa7, 0xa8, 0xd3, 0xd4, 0x00, 0x03,
+	0xd4, 0xbf, 0xb3, 0x5d, 0x33, 0x80, 0x93, 0xcc, 0x0a, 0xfa, 0xc9, 0x05,
+	0x31, 0xb7, 0x19, 0x6b, 0xc0, 0x93, 0x1a, 0x8d, 0x10, 0xd4, 0xa2, 0x42,
+	0x10, 0x19, 0x52, 0x1c, 0xc9, 0x44, 0x96, 0xce, 0x02, 0xb8, 0x3c, 0x8e,
+	0x78, 0x03, 0x24, 0xc3, 0x05, 0x1d, 0xb6, 0x2b, 0xa5, 0x72, 0x28, 0x79,
+	0x17, 0x65, 0x4b, 0x58, 0xd4, 0xa0, 0xd8, 0x18, 0x88, 0x4c, 0x1c, 0x59,
+	0x37, 0xc4, 0xf6, 0x61, 0xf2, 0x85, 0xdc, 0x89, 0x11, 0x12, 0x24, 0x66,
+	0xdc, 0xbb, 0xf8, 0xbb, 0xbc, 0xb2, 0x21, 0xfc, 0x5d, 0xc9, 0x14, 0xe1,
+	0x42, 0x43, 0xb9, 0xb6, 0x72, 0x10,
+}
+
+func TestExtractTarBz2(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarBz2(bytes.NewReader(bzip2TestTar), tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractReaderBzip2MagicName(t *testing.T) {
+	// An uncompressed tarball starting with the bzip2 magic
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "BZhello.txt",
+				Size: 5,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	expectedFiles := []*fileInfo{
+		{path: "BZhello.txt", typeflag: tar.TypeReg, size: 5, contents: "hello"},
+	}
+	for _, tt := range []struct {
+		name    string
+		extract func(io.Reader, string, ...Option) error
+	}{
+		{"ExtractReader", ExtractReader},
+		{"ExtractTarGz", ExtractTarGz},
+		{"ExtractTarBz2", ExtractTarBz2},
+		{"ExtractTarXz", ExtractTarXz},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := tt.extract(bytes.NewReader(data), tmpdir); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestDecompressingReaderEmptyBzip2(t *testing.T) {
+	// An empty bzip2 stream has no block, only the end of stream magic
+	empty := []byte("BZh9\x17\x72\x45\x38\x50\x90\x00\x00\x00\x00")
+	r, err := DecompressingReader(bytes.NewReader(empty))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("unexpected data: %v", data)
+	}
+}
+
+func TestExtractTarXz(t *testing.T) {
+	// A fake xz stream: the xz magic followed by the uncompressed tarball
+	fakeXz := append(append([]byte{}, xzMagic...), readTestTar(t, compressionTestEntries())...)
+
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarXz(bytes.NewReader(fakeXz), tmpdir); err != ErrNoXzDecompressor {
+		t.Fatalf("expected ErrNoXzDecompressor, got: %v", err)
+	}
+
+	SetXzDecompressor(func(r io.Reader) (io.Reader, error) {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(len(xzMagic))); err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+	defer SetXzDecompressor(nil)
+	if err := ExtractTarXz(bytes.NewReader(fakeXz), tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir, compressionTestExpectedFiles()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CreateOption configures the creation of a tarball by CreateTar.
+type CreateOption func(*creator)
+
+// creator holds the configuration and the state of a tarball creation.
+type creator struct {
+	include       []string
+	exclude       []string
+	deterministic bool
+
+	tw  *tar.Writer
+	dir string
+	// inodes maps the inodes with several links to the name of the first
+	// entry written for them
+	inodes map[inode]string
+}
+
+// inode identifies a file on the system.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// WithInclude makes CreateTar archive only the paths matching one of the
+// given patterns, and the contents of the matching directories. The patterns
+// use the filepath.Match syntax and are matched against the paths relative
+// to the archived directory, or against the base names for the patterns
+// without a separator. The parent directories of the included paths aren't
+// archived unless they match too.
+func WithInclude(patterns ...string) CreateOption {
+	return func(c *creator) {
+		c.include = append(c.include, patterns...)
+	}
+}
+
+// WithExclude makes CreateTar skip the paths matching one of the given
+// patterns, and the contents of the matching directories. The patterns use
+// the filepath.Match syntax and are matched like with WithInclude. Exclusions
+// take precedence over inclusions.
+func WithExclude(patterns ...string) CreateOption {
+	return func(c *creator) {
+		c.exclude = append(c.exclude, patterns...)
+	}
+}
+
+// WithDeterministic makes CreateTar produce reproducible tarballs, which only
+// depend on the names, types, modes, contents and link targets of the
+// archived files. The entries are written in the lexical order of the tree,
+// with the times set to the Unix epoch and the owner set to root.
+func WithDeterministic() CreateOption {
+	return func(c *creator) {
+		c.deterministic = true
+	}
+}
+
+// CreateTar writes to w a tarball of the contents of dir. Regular files,
+// directories, symlinks, device nodes and fifos are archived, with the
+// further links to the same file written as hardlinks. Sockets are skipped.
+func CreateTar(w io.Writer, dir string, opts ...CreateOption) error {
+	c := &creator{
+		tw:     tar.NewWriter(w),
+		dir:    dir,
+		inodes: make(map[inode]string),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := filepath.Walk(dir, c.walk); err != nil {
+		return err
+	}
+	return c.tw.Close()
+}
+
+// CreateTarGz writes to w a gzip compressed tarball of the contents of dir,
+// like CreateTar. The level is a compress/gzip compression level, from
+// gzip.HuffmanOnly to gzip.BestCompression. The gzip stream is terminated
+// even when the tarball can't be created.
+func CreateTarGz(w io.Writer, dir string, level int, opts ...CreateOption) (err error) {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := zw.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+	return CreateTar(zw, dir, opts...)
+}
+
+// CreateTarFS writes to w a tarball of the contents of the directory root of
+// fsys, like CreateTar. The io/fs interfaces can't represent symlinks,
+// device nodes and fifos, so only the regular files and the directories are
+// archived, and the other files are skipped. The further links to the same
+// file are written as hardlinks when the FileInfos give the inodes, like the
+// ones of os.DirFS.
+func CreateTarFS(w io.Writer, fsys fs.FS, root string, opts ...CreateOption) error {
+	c := &creator{
+		tw:     tar.NewWriter(w),
+		inodes: make(map[inode]string),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	err := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel := p
+		if root != "." {
+			rel = strings.TrimPrefix(p, root+"/")
+		}
+		rel = filepath.FromSlash(rel)
+		if skip, err := c.skip(rel, d.IsDir()); skip || err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := c.writeFSEntry(fsys, p, rel, info); err != nil {
+			return fmt.Errorf("could not archive %q: %w", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.tw.Close()
+}
+
+func (c *creator) walk(p string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if p == c.dir {
+		return nil
+	}
+	rel, err := filepath.Rel(c.dir, p)
+	if err != nil {
+		return err
+	}
+	if skip, err := c.skip(rel, info.IsDir()); skip || err != nil {
+		return err
+	}
+	if err := c.writeEntry(p, rel, info); err != nil {
+		return fmt.Errorf("could not archive %q: %w", p, err)
+	}
+	return nil
+}
+
+// skip returns whether the file at the path rel in the tarball isn't
+// archived because of the inclusion and exclusion patterns. The error is
+// filepath.SkipDir for the excluded directories.
+func (c *creator) skip(rel string, isDir bool) (bool, error) {
+	excluded, err := matchAny(c.exclude, rel)
+	if err != nil {
+		return true, err
+	}
+	if excluded {
+		if isDir {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+	if len(c.include) > 0 {
+		included, err := c.isIncluded(rel)
+		if err != nil {
+			return true, err
+		}
+		// Directories that aren't included are still walked, since
+		// the patterns can match paths deeper in the tree
+		if !included {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isIncluded returns whether rel or one of its parent directories matches
+// the inclusion patterns.
+func (c *creator) isIncluded(rel string) (bool, error) {
+	for p := rel; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		match, err := matchAny(c.include, p)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// writeEntry writes the entry for the file p, at the path rel in the tarball.
+func (c *creator) writeEntry(p, rel string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := c.header(rel, info, link)
+	if err != nil {
+		return err
+	}
+
+	if linked, err := c.writeLink(hdr, info); linked || err != nil {
+		return err
+	}
+	if err := c.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(c.tw, f)
+	return err
+}
+
+// writeFSEntry writes the entry for the file p of fsys, at the path rel in
+// the tarball.
+func (c *creator) writeFSEntry(fsys fs.FS, p, rel string, info fs.FileInfo) error {
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+	hdr, err := c.header(rel, info, "")
+	if err != nil {
+		return err
+	}
+	if linked, err := c.writeLink(hdr, info); linked || err != nil {
+		return err
+	}
+	if err := c.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(c.tw, f)
+	return err
+}
+
+// writeLink writes hdr as a hardlink, and returns true, when the file
+// described by info is a further link to a file already archived. Otherwise
+// the first link to a file with several ones is recorded.
+func (c *creator) writeLink(hdr *tar.Header, info os.FileInfo) (bool, error) {
+	ino, ok := fileInode(info)
+	if !ok || info.IsDir() {
+		return false, nil
+	}
+	first, ok := c.inodes[ino]
+	if !ok {
+		c.inodes[ino] = hdr.Name
+		return false, nil
+	}
+	hdr.Typeflag = tar.TypeLink
+	hdr.Linkname = first
+	hdr.Size = 0
+	return true, c.tw.WriteHeader(hdr)
+}
+
+// header returns the header of the file described by info, at the path rel
+// in the tarball.
+func (c *creator) header(rel string, info os.FileInfo, link string) (*tar.Header, error) {
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if c.deterministic {
+		normalizeHeader(hdr)
+	}
+	return hdr, nil
+}
+
+// normalizeHeader clears the fields of hdr that depend on when and by whom
+// the archived file was created. filepath.Walk already goes through the tree
+// in lexical order.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.ModTime = time.Unix(0, 0)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if hdr.Typeflag != tar.TypeChar && hdr.Typeflag != tar.TypeBlock {
+		hdr.Devmajor = 0
+		hdr.Devminor = 0
+	}
+}
+
+// matchAny returns whether name matches one of the patterns. Like with tar,
+// the patterns without a separator are matched against the base name.
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		n := name
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			n = filepath.Base(name)
+		}
+		match, err := filepath.Match(pattern, n)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
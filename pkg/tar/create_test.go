@@ -0,0 +1,431 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestTree creates a directory tree for the CreateTar tests.
+func newTestTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, d := range []string{"bin", "etc", "var/lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	files := map[string]string{
+		"bin/foo":      "foo",
+		"etc/foo.conf": "conf",
+		"etc/foo.bak":  "backup",
+		"var/lib/db":   "db",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := os.Symlink("foo", filepath.Join(dir, "bin/bar")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Link(filepath.Join(dir, "bin/foo"), filepath.Join(dir, "bin/baz")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return dir
+}
+
+// createAndExtract archives dir with CreateTar and extracts the result in a
+// new temporary directory.
+func createAndExtract(t *testing.T, dir string, opts ...CreateOption) string {
+	var buf bytes.Buffer
+	if err := CreateTar(&buf, dir, opts...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewExtractor().Extract(tar.NewReader(&buf), outdir); err != nil {
+		os.RemoveAll(outdir)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return outdir
+}
+
+func TestCreateTar(t *testing.T) {
+	dir := newTestTree(t)
+	defer os.RemoveAll(dir)
+	outdir := createAndExtract(t, dir)
+	defer os.RemoveAll(outdir)
+
+	expectedFiles := []*fileInfo{
+		{path: "bin", typeflag: tar.TypeDir},
+		{path: "bin/foo", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "bin/bar", typeflag: tar.TypeSymlink},
+		{path: "bin/baz", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/foo.conf", typeflag: tar.TypeReg, size: 4, contents: "conf"},
+		{path: "etc/foo.bak", typeflag: tar.TypeReg, size: 6, contents: "backup"},
+		{path: "var", typeflag: tar.TypeDir},
+		{path: "var/lib", typeflag: tar.TypeDir},
+		{path: "var/lib/db", typeflag: tar.TypeReg, size: 2, contents: "db"},
+	}
+	if err := checkExpectedFiles(outdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	link, err := os.Readlink(filepath.Join(outdir, "bin/bar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link != "foo" {
+		t.Errorf("unexpected symlink target, wanted: %q, got: %q", "foo", link)
+	}
+	foo, err := os.Stat(filepath.Join(outdir, "bin/foo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	baz, err := os.Stat(filepath.Join(outdir, "bin/baz"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !os.SameFile(foo, baz) {
+		t.Errorf("expected bin/baz to be a hardlink to bin/foo")
+	}
+}
+
+func TestCreateTarGz(t *testing.T) {
+	dir := newTestTree(t)
+	defer os.RemoveAll(dir)
+
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		var buf bytes.Buffer
+		if err := CreateTarGz(&buf, dir, level, WithExclude("bin")); err != nil {
+			t.Fatalf("level %d: unexpected error: %v", level, err)
+		}
+		zr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("level %d: unexpected error: %v", level, err)
+		}
+		outdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(outdir)
+		if err := NewExtractor().Extract(tar.NewReader(zr), outdir); err != nil {
+			t.Fatalf("level %d: unexpected error: %v", level, err)
+		}
+		expectedFiles := []*fileInfo{
+			{path: "etc", typeflag: tar.TypeDir},
+			{path: "etc/foo.conf", typeflag: tar.TypeReg, size: 4, contents: "conf"},
+			{path: "etc/foo.bak", typeflag: tar.TypeReg, size: 6, contents: "backup"},
+			{path: "var", typeflag: tar.TypeDir},
+			{path: "var/lib", typeflag: tar.TypeDir},
+			{path: "var/lib/db", typeflag: tar.TypeReg, size: 2, contents: "db"},
+		}
+		if err := checkExpectedFiles(outdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("level %d: unexpected error: %v", level, err)
+		}
+	}
+
+	if err := CreateTarGz(ioutil.Discard, dir, gzip.BestCompression+1); err == nil {
+		t.Errorf("expected an error for an invalid level")
+	}
+
+	// The gzip stream is terminated when the tarball can't be created
+	var buf bytes.Buffer
+	if err := CreateTarGz(&buf, filepath.Join(dir, "missing"), gzip.DefaultCompression); err == nil {
+		t.Fatalf("expected an error for a missing directory")
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateTarFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/bin/foo":      {Data: []byte("foo"), Mode: 0755},
+		"app/etc/foo.conf": {Data: []byte("conf"), Mode: 0600},
+		"app/etc/foo.bak":  {Data: []byte("backup"), Mode: 0644},
+		"app/var/lib":      {Mode: os.ModeDir | 0700},
+		// Not representable by io/fs, skipped
+		"app/bin/bar": {Data: []byte("foo"), Mode: os.ModeSymlink | 0777},
+		"other/file":  {Data: []byte("other")},
+	}
+	var buf bytes.Buffer
+	if err := CreateTarFS(&buf, fsys, "app", WithExclude("*.bak")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+	if err := NewExtractor().Extract(tar.NewReader(&buf), outdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFiles := []*fileInfo{
+		{path: "bin", typeflag: tar.TypeDir, mode: 0555},
+		{path: "bin/foo", typeflag: tar.TypeReg, size: 3, mode: 0755, contents: "foo"},
+		{path: "etc", typeflag: tar.TypeDir, mode: 0555},
+		{path: "etc/foo.conf", typeflag: tar.TypeReg, size: 4, mode: 0600, contents: "conf"},
+		{path: "var", typeflag: tar.TypeDir, mode: 0555},
+		{path: "var/lib", typeflag: tar.TypeDir, mode: 0700},
+	}
+	if err := checkExpectedFiles(outdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateTarHardlinkHeaders(t *testing.T) {
+	dir := newTestTree(t)
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	if err := CreateTar(&buf, dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hdrs, err := ListTar(tar.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// filepath.Walk goes through the tree in lexical order, so bin/baz
+	// comes before bin/foo
+	types := make(map[string]*tar.Header)
+	for _, hdr := range hdrs {
+		types[hdr.Name] = hdr
+	}
+	if hdr := types["bin/baz"]; hdr == nil || hdr.Typeflag != tar.TypeReg {
+		t.Errorf("expected bin/baz to be a regular file, got: %+v", hdr)
+	}
+	if hdr := types["bin/foo"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "bin/baz" {
+		t.Errorf("expected bin/foo to be a hardlink to bin/baz, got: %+v", hdr)
+	}
+}
+
+func TestCreateTarHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	busybox := filepath.Join(dir, "bin/busybox")
+	if err := ioutil.WriteFile(busybox, bytes.Repeat([]byte("busybox"), 1024), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	applets := []string{"sh", "ls", "cat", "mv"}
+	for _, applet := range applets {
+		if err := os.Link(busybox, filepath.Join(dir, "bin", applet)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for name, create := range map[string]func(*bytes.Buffer) error{
+		"CreateTar": func(buf *bytes.Buffer) error {
+			return CreateTar(buf, dir)
+		},
+		"CreateTarFS": func(buf *bytes.Buffer) error {
+			return CreateTarFS(buf, os.DirFS(dir), ".")
+		},
+	} {
+		var buf bytes.Buffer
+		if err := create(&buf); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		// The contents are only archived once
+		if buf.Len() > 2*7*1024 {
+			t.Errorf("%s: the contents of the links are duplicated, the tarball is %d bytes", name, buf.Len())
+		}
+		outdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(outdir)
+		if err := NewExtractor().Extract(tar.NewReader(&buf), outdir); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		first, err := os.Stat(filepath.Join(outdir, "bin/busybox"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		for _, applet := range applets {
+			info, err := os.Stat(filepath.Join(outdir, "bin", applet))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if !os.SameFile(first, info) {
+				t.Errorf("%s: expected bin/%s to be a hardlink to bin/busybox", name, applet)
+			}
+		}
+	}
+}
+
+func TestCreateTarIncludeExclude(t *testing.T) {
+	dir := newTestTree(t)
+	defer os.RemoveAll(dir)
+
+	outdir := createAndExtract(t, dir, WithInclude("etc", "var/lib/*"), WithExclude("*.bak"))
+	defer os.RemoveAll(outdir)
+	expectedFiles := []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/foo.conf", typeflag: tar.TypeReg, size: 4, contents: "conf"},
+		// Created by the extraction as the parent of var/lib/db
+		{path: "var", typeflag: tar.TypeDir},
+		{path: "var/lib", typeflag: tar.TypeDir},
+		{path: "var/lib/db", typeflag: tar.TypeReg, size: 2, contents: "db"},
+	}
+	if err := checkExpectedFiles(outdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	outdir2 := createAndExtract(t, dir, WithExclude("bin", "var"))
+	defer os.RemoveAll(outdir2)
+	expectedFiles = []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/foo.conf", typeflag: tar.TypeReg, size: 4, contents: "conf"},
+		{path: "etc/foo.bak", typeflag: tar.TypeReg, size: 6, contents: "backup"},
+	}
+	if err := checkExpectedFiles(outdir2, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateTarIncludeExcludeSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.go":            "main",
+		"main_test.go":       "test",
+		"pkg/tar/tar.go":     "tar",
+		"pkg/tar/tar.o":      "object",
+		"build/rkt":          "binary",
+		".git/HEAD":          "ref",
+		".git/hooks/hook.go": "hook",
+	}
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The excluded directories aren't descended, even to find included
+	// files
+	outdir := createAndExtract(t, dir, WithInclude("*.go"), WithExclude(".git", "*_test.go"))
+	defer os.RemoveAll(outdir)
+	expectedFiles := []*fileInfo{
+		{path: "main.go", typeflag: tar.TypeReg, size: 4, contents: "main"},
+		// Created by the extraction as the parents of tar.go
+		{path: "pkg", typeflag: tar.TypeDir},
+		{path: "pkg/tar", typeflag: tar.TypeDir},
+		{path: "pkg/tar/tar.go", typeflag: tar.TypeReg, size: 3, contents: "tar"},
+	}
+	if err := checkExpectedFiles(outdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateTarDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping the test, creating device nodes requires root")
+	}
+	dir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// /dev/null
+	if err := mknod(filepath.Join(dir, "null"), os.ModeDevice|os.ModeCharDevice|0666, 1, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := CreateTar(&buf, dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hdrs, err := ListTar(tar.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hdrs) != 1 {
+		t.Fatalf("expected one entry, got: %d", len(hdrs))
+	}
+	hdr := hdrs[0]
+	if hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 1 || hdr.Devminor != 3 {
+		t.Errorf("unexpected header, wanted a char device 1:3, got: %c %d:%d", hdr.Typeflag, hdr.Devmajor, hdr.Devminor)
+	}
+}
+
+func TestCreateTarDeterministic(t *testing.T) {
+	sum := func(dir string) [sha256.Size]byte {
+		var buf bytes.Buffer
+		if err := CreateTar(&buf, dir, WithDeterministic()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return sha256.Sum256(buf.Bytes())
+	}
+
+	dir1 := newTestTree(t)
+	defer os.RemoveAll(dir1)
+	dir2 := newTestTree(t)
+	defer os.RemoveAll(dir2)
+	// Give the second tree different times
+	past := time.Now().Add(-time.Hour)
+	err := filepath.Walk(dir2, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chtimes(p, past, past)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sum1 := sum(dir1)
+	if sum2 := sum(dir1); sum1 != sum2 {
+		t.Errorf("archiving the same tree twice gave different tarballs")
+	}
+	if sum2 := sum(dir2); sum1 != sum2 {
+		t.Errorf("archiving identical trees gave different tarballs")
+	}
+}
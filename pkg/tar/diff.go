@@ -0,0 +1,116 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// TarDiff lists the differences between two tarballs. The names are the
+// cleaned paths of the entries, sorted.
+type TarDiff struct {
+	// OnlyInA contains the entries only found in the first tarball
+	OnlyInA []string
+	// OnlyInB contains the entries only found in the second tarball
+	OnlyInB []string
+	// Changed contains the entries found in both tarballs with a
+	// different type, mode, size, link target or contents
+	Changed []string
+}
+
+// entrySummary describes an entry compared by DiffTars.
+type entrySummary struct {
+	typeflag byte
+	mode     int64
+	size     int64
+	linkname string
+	// sum is the digest of the contents
+	sum [sha256.Size]byte
+}
+
+// DiffTars compares the entries of the tarballs a and b, by their cleaned
+// paths. The entries of a are summarized in memory, with a digest of their
+// contents, and the ones of b are compared while b is read. When a tarball
+// contains several entries with the same path, the last one is compared.
+func DiffTars(a, b *tar.Reader) (*TarDiff, error) {
+	summaries := make(map[string]*entrySummary)
+	if err := summarizeTar(a, func(name string, s *entrySummary) {
+		summaries[name] = s
+	}); err != nil {
+		return nil, err
+	}
+
+	// changed maps the paths of the entries of b to whether they differ
+	// from the ones of a
+	changed := make(map[string]bool)
+	if err := summarizeTar(b, func(name string, s *entrySummary) {
+		sa, ok := summaries[name]
+		changed[name] = ok && *sa != *s
+	}); err != nil {
+		return nil, err
+	}
+	diff := &TarDiff{}
+	for name := range summaries {
+		if _, ok := changed[name]; !ok {
+			diff.OnlyInA = append(diff.OnlyInA, name)
+		}
+	}
+	for name, c := range changed {
+		switch {
+		case summaries[name] == nil:
+			diff.OnlyInB = append(diff.OnlyInB, name)
+		case c:
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	sort.Strings(diff.OnlyInA)
+	sort.Strings(diff.OnlyInB)
+	sort.Strings(diff.Changed)
+	return diff, nil
+}
+
+// summarizeTar calls fn with the cleaned path and the summary of every entry
+// of the tarball read from tr.
+func summarizeTar(tr *tar.Reader, fn func(string, *entrySummary)) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+		}
+		s := &entrySummary{
+			typeflag: hdr.Typeflag,
+			mode:     hdr.Mode,
+			size:     hdr.Size,
+			linkname: hdr.Linkname,
+		}
+		if s.typeflag == tar.TypeRegA {
+			s.typeflag = tar.TypeReg
+		}
+		copy(s.sum[:], h.Sum(nil))
+		fn(filepath.Clean(hdr.Name), s)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTars(t *testing.T) {
+	base := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "etc/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+		},
+		{
+			contents: "conf",
+			header: &tar.Header{
+				Name: "etc/foo.conf",
+				Size: 4,
+				Mode: 0644,
+			},
+		},
+		{
+			contents: "bin",
+			header: &tar.Header{
+				Name: "bin/foo",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "removed",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+	}
+	other := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "./etc",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+		},
+		{
+			// Same size, other contents
+			contents: "CONF",
+			header: &tar.Header{
+				Name: "etc/foo.conf",
+				Size: 4,
+				Mode: 0644,
+			},
+		},
+		{
+			contents: "bin",
+			header: &tar.Header{
+				Name: "bin/foo",
+				Size: 3,
+				Mode: 0755,
+			},
+		},
+		{
+			contents: "new",
+			header: &tar.Header{
+				Name: "added",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+	}
+	a := tar.NewReader(bytes.NewReader(readTestTar(t, base)))
+	b := tar.NewReader(bytes.NewReader(readTestTar(t, other)))
+	diff, err := DiffTars(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &TarDiff{
+		OnlyInA: []string{"removed"},
+		OnlyInB: []string{"added"},
+		Changed: []string{"bin/foo", "etc/foo.conf"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff, wanted: %+v, got: %+v", expected, diff)
+	}
+
+	a = tar.NewReader(bytes.NewReader(readTestTar(t, base)))
+	b = tar.NewReader(bytes.NewReader(readTestTar(t, base)))
+	diff, err = DiffTars(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(diff, &TarDiff{}) {
+		t.Errorf("expected no differences, got: %+v", diff)
+	}
+}
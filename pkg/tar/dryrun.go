@@ -0,0 +1,276 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dryRunFS is the FS of the dry runs. It records the entries created and
+// removed by an extraction on top of the ones of base, which isn't modified.
+type dryRunFS struct {
+	base FS
+
+	mu sync.Mutex
+	// files contains the entries created by the extraction
+	files map[string]*dryRunInfo
+	// removed contains the paths removed by the extraction, hiding them
+	// and their contents in base
+	removed map[string]struct{}
+}
+
+// dryRunInfo describes an entry created by a dry run.
+type dryRunInfo struct {
+	name string
+	mode os.FileMode
+}
+
+// dryRunFile is a regular file created by a dry run. What's written to it
+// is discarded.
+type dryRunFile struct {
+	off  int64
+	size int64
+}
+
+func newDryRunFS(base FS) *dryRunFS {
+	return &dryRunFS{
+		base:    base,
+		files:   make(map[string]*dryRunInfo),
+		removed: make(map[string]struct{}),
+	}
+}
+
+// lstat returns the FileInfo of name, as created by the extraction or found
+// in base. It must be called with mu held.
+func (fs *dryRunFS) lstat(name string) (os.FileInfo, error) {
+	if info, ok := fs.files[name]; ok {
+		return info, nil
+	}
+	for p := name; ; p = filepath.Dir(p) {
+		if _, ok := fs.removed[p]; ok {
+			return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+		}
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+	return fs.base.Lstat(name)
+}
+
+// create records the entry name with the given mode, failing like the
+// operating system when it exists or its parent isn't a directory. It must
+// be called with mu held.
+func (fs *dryRunFS) create(op, name string, mode os.FileMode) error {
+	if _, err := fs.lstat(name); err == nil {
+		return &os.PathError{Op: op, Path: name, Err: syscall.EEXIST}
+	}
+	parent, err := fs.lstat(filepath.Dir(name))
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	if !parent.IsDir() && parent.Mode()&os.ModeSymlink == 0 {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	fs.files[name] = &dryRunInfo{name: filepath.Base(name), mode: mode}
+	return nil
+}
+
+// exists returns an error if name doesn't exist. It must be called with mu
+// held.
+func (fs *dryRunFS) exists(op, name string) error {
+	if _, err := fs.lstat(name); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	return nil
+}
+
+func (fs *dryRunFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.lstat(name)
+	switch {
+	case err != nil:
+		if err := fs.create("open", name, perm.Perm()); err != nil {
+			return nil, err
+		}
+	case flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &dryRunFile{}, nil
+}
+
+func (fs *dryRunFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.create("mkdir", name, os.ModeDir|perm.Perm())
+}
+
+func (fs *dryRunFS) Symlink(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.create("symlink", newname, os.ModeSymlink|0777); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: pathErrno(err)}
+	}
+	return nil
+}
+
+func (fs *dryRunFS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.lstat(oldname)
+	if err == nil {
+		err = fs.create("link", newname, info.Mode())
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: pathErrno(err)}
+	}
+	return nil
+}
+
+func (fs *dryRunFS) Chmod(name string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.exists("chmod", name); err != nil {
+		return err
+	}
+	if info, ok := fs.files[name]; ok {
+		info.mode = info.mode&os.ModeType | mode.Perm()
+	}
+	return nil
+}
+
+func (fs *dryRunFS) Lchown(name string, uid, gid int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.exists("lchown", name)
+}
+
+func (fs *dryRunFS) Lchtimes(name string, atime, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.exists("lchtimes", name)
+}
+
+func (fs *dryRunFS) Mknod(name string, mode os.FileMode, major, minor int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.create("mknod", name, mode)
+}
+
+func (fs *dryRunFS) Lstat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.lstat(name)
+}
+
+func (fs *dryRunFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.lstat(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: pathErrno(err)}
+	}
+	if info.IsDir() {
+		// The contents of the directories of base aren't known, they're
+		// assumed not to be empty
+		_, created := fs.files[name]
+		for p := range fs.files {
+			if strings.HasPrefix(p, name+string(filepath.Separator)) {
+				created = false
+				break
+			}
+		}
+		if !created {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(fs.files, name)
+	fs.removed[name] = struct{}{}
+	return nil
+}
+
+func (fs *dryRunFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for p := range fs.files {
+		if p == name || strings.HasPrefix(p, name+string(filepath.Separator)) {
+			delete(fs.files, p)
+		}
+	}
+	fs.removed[name] = struct{}{}
+	return nil
+}
+
+func (fs *dryRunFS) Lsetxattr(name, attr string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.exists("lsetxattr", name); err != nil {
+		return err
+	}
+	if _, ok := fs.base.(XattrFS); !ok {
+		return ErrNotSupportedPlatform
+	}
+	return nil
+}
+
+// pathErrno returns the underlying error of err, when it's an *os.PathError.
+func pathErrno(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+func (f *dryRunFile) Write(p []byte) (int, error) {
+	f.off += int64(len(p))
+	if f.off > f.size {
+		f.size = f.off
+	}
+	return len(p), nil
+}
+
+func (f *dryRunFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *dryRunFile) Truncate(size int64) error {
+	f.size = size
+	return nil
+}
+
+func (f *dryRunFile) Sync() error  { return nil }
+func (f *dryRunFile) Close() error { return nil }
+
+func (i *dryRunInfo) Name() string       { return i.name }
+func (i *dryRunInfo) Size() int64        { return 0 }
+func (i *dryRunInfo) Mode() os.FileMode  { return i.mode }
+func (i *dryRunInfo) ModTime() time.Time { return time.Time{} }
+func (i *dryRunInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *dryRunInfo) Sys() interface{}   { return nil }
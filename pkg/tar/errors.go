@@ -0,0 +1,245 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMaxBytesExceeded is returned when an extraction would write more
+	// bytes than allowed with WithMaxTotalBytes.
+	ErrMaxBytesExceeded = errors.New("maximum number of bytes exceeded")
+	// ErrMaxEntriesExceeded is returned when an archive contains more
+	// entries than allowed with WithMaxEntries.
+	ErrMaxEntriesExceeded = errors.New("maximum number of entries exceeded")
+	// ErrMaxDepthExceeded is returned when the path of an entry contains
+	// more components than allowed with WithMaxDepth.
+	ErrMaxDepthExceeded = errors.New("maximum path depth exceeded")
+
+	// errSkipped is returned by extractFile when the options of the
+	// Extractor make it skip an entry
+	errSkipped = errors.New("entry skipped")
+)
+
+// InsecurePathError is returned when the path of an entry is outside of the
+// target directory.
+type InsecurePathError struct {
+	// Name is the name of the entry
+	Name string
+	// Dir is the target directory
+	Dir string
+}
+
+func (e *InsecurePathError) Error() string {
+	return fmt.Sprintf("insecure path %q outside of %q", e.Name, e.Dir)
+}
+
+// InsecureLinkError is returned when a hardlink or a symlink points outside
+// of the target directory, or when the path of an entry goes through a
+// symlink created earlier in the extraction, or any symlink with
+// WithSafeParents.
+type InsecureLinkError struct {
+	// Path is the path of the entry
+	Path string
+	// Link is the target of the link, or the symlink the path goes
+	// through
+	Link string
+	// Type is the type flag of the link entry, tar.TypeLink or
+	// tar.TypeSymlink, or 0 when Path goes through the symlink Link
+	Type byte
+}
+
+func (e *InsecureLinkError) Error() string {
+	switch e.Type {
+	case tar.TypeLink:
+		return fmt.Sprintf("insecure link %q -> %q", e.Path, e.Link)
+	case tar.TypeSymlink:
+		return fmt.Sprintf("insecure symlink %q -> %q", e.Path, e.Link)
+	default:
+		return fmt.Sprintf("insecure path %q through symlink %q", e.Path, e.Link)
+	}
+}
+
+// UnsupportedTypeError is returned when an entry has a type that can't be
+// extracted.
+type UnsupportedTypeError struct {
+	// Name is the name of the entry
+	Name string
+	// Type is the type flag of the entry
+	Type byte
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported type %q for %q", e.Type, e.Name)
+}
+
+// InvalidNameError is returned when the name or the link target of an entry
+// contains a NUL byte, or is an absolute path rejected with
+// AbsolutePathsReject.
+type InvalidNameError struct {
+	// Name is the invalid name
+	Name string
+	// Absolute is true when Name is rejected as an absolute path
+	Absolute bool
+}
+
+func (e *InvalidNameError) Error() string {
+	if e.Absolute {
+		return fmt.Sprintf("absolute path %q", e.Name)
+	}
+	return fmt.Sprintf("invalid name %q: contains a NUL byte", e.Name)
+}
+
+// ChecksumMismatchError is returned by the extractions made with WithVerify
+// when the digest of a regular file doesn't match the expected one, or when a
+// file isn't expected or is missing.
+type ChecksumMismatchError struct {
+	// Name is the cleaned name of the file
+	Name string
+	// Want is the expected digest, empty if the file isn't expected
+	Want string
+	// Got is the digest of the file, empty if it's missing
+	Got string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	switch {
+	case e.Want == "":
+		return fmt.Sprintf("unexpected file %q", e.Name)
+	case e.Got == "":
+		return fmt.Sprintf("missing file %q, wanted digest %s", e.Name, e.Want)
+	}
+	return fmt.Sprintf("checksum mismatch for %q: wanted %s, got %s", e.Name, e.Want, e.Got)
+}
+
+// CaseCollisionError is returned by the extractions made with
+// WithDetectCaseCollisions when the path of an entry only differs in case
+// from the path of an entry extracted earlier, or from one of its parents.
+type CaseCollisionError struct {
+	// Name is the name of the entry
+	Name string
+	// Existing is the path it collides with
+	Existing string
+}
+
+func (e *CaseCollisionError) Error() string {
+	return fmt.Sprintf("path of %q collides with %q on case-insensitive filesystems", e.Name, e.Existing)
+}
+
+// DuplicateEntryError is returned by the extractions made with
+// WithDetectDuplicates when an entry replaces an entry of another type
+// extracted earlier.
+type DuplicateEntryError struct {
+	// Name is the cleaned name of the entry
+	Name string
+	// Type is the type flag of the entry
+	Type byte
+	// Existing is the type flag of the entry extracted earlier, with
+	// the regular files and hardlinks as tar.TypeReg
+	Existing byte
+}
+
+func (e *DuplicateEntryError) Error() string {
+	return fmt.Sprintf("entry %q of type %q replaces an entry of type %q", e.Name, e.Type, e.Existing)
+}
+
+// CrossDeviceError is returned by the extractions made with WithStayOnDevice
+// when an entry would be written on another device than the target
+// directory.
+type CrossDeviceError struct {
+	// Name is the name of the entry
+	Name string
+	// Path is the path of the entry in the target directory
+	Path string
+}
+
+func (e *CrossDeviceError) Error() string {
+	return fmt.Sprintf("path %q of %q is on another device", e.Path, e.Name)
+}
+
+// TimeoutError is returned when the contents of an entry couldn't be read in
+// the time given to WithEntryTimeout.
+type TimeoutError struct {
+	// Name is the name of the entry
+	Name string
+	// Timeout is the time the entry could be read in
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out reading %q after %v", e.Name, e.Timeout)
+}
+
+// TruncatedArchiveError is returned when an archive ends unexpectedly, in the
+// middle of a header or of the contents of an entry. It usually means the
+// archive is incomplete, for example because a download was interrupted,
+// rather than corrupted.
+type TruncatedArchiveError struct {
+	// Name is the name of the last entry read before the end of the
+	// archive, empty if there is none
+	Name string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *TruncatedArchiveError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("truncated archive: %v", e.Err)
+	}
+	return fmt.Sprintf("truncated archive, last entry %q: %v", e.Name, e.Err)
+}
+
+func (e *TruncatedArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned by the extractions made with WithContinueOnError,
+// with the errors of the entries that could not be extracted.
+type MultiError struct {
+	Errors []error
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d entries could not be extracted: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *MultiError) Unwrap() []error {
+	return e.Errors
+}
+
+// isFatal returns whether err aborts an extraction, also with
+// WithContinueOnError: insecure or invalid entries, exceeded limits,
+// truncated archives and cancellations.
+func isFatal(err error) bool {
+	var pathErr *InsecurePathError
+	var linkErr *InsecureLinkError
+	var nameErr *InvalidNameError
+	var truncErr *TruncatedArchiveError
+	var timeoutErr *TimeoutError
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &nameErr) || errors.As(err, &truncErr) || errors.As(err, &timeoutErr) ||
+		errors.Is(err, ErrMaxBytesExceeded) || errors.Is(err, ErrMaxEntriesExceeded) ||
+		errors.Is(err, ErrMaxDepthExceeded) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
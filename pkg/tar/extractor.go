@@ -0,0 +1,2204 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// paxSchilyXattr is the prefix of the PAX records holding extended
+// attributes.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// capabilityXattr is the extended attribute holding the file capabilities
+// of an executable.
+const capabilityXattr = "security.capability"
+
+// The extended attributes holding the POSIX ACLs of a file, and the default
+// ACLs of the files created in a directory.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// Extractor extracts tarballs into a directory. Its behavior is configured
+// with the Options given to NewExtractor.
+type Extractor struct {
+	overwrite OverwritePolicy
+	pwl       PathWhitelistMap
+	editor    FilePermissionsEditor
+
+	chown              bool
+	chownStrict        bool
+	preserveTimes      bool
+	fixedTimes         bool
+	fixedTime          time.Time
+	umask              int
+	setUmask           bool
+	xattrs             bool
+	xattrsStrict       bool
+	acls               bool
+	aclsStrict         bool
+	filter             func(*tar.Header) bool
+	strip              int
+	rename             func(name string) (string, bool)
+	transform          HeaderTransform
+	progress           ProgressFunc
+	maxBytes           int64
+	maxEntries         int
+	maxDepth           int
+	entryTimeout       time.Duration
+	whiteouts          bool
+	skipUnsupported    bool
+	hardlinkFallback   bool
+	deviceNodes        DeviceNodePolicy
+	uidMap             []IDMapRange
+	gidMap             []IDMapRange
+	staging            bool
+	dryRun             bool
+	chroot             bool
+	fsync              FsyncPolicy
+	sanitizeModes      bool
+	sanitizeSticky     bool
+	manifest           *[]ExtractedEntry
+	stats              *Stats
+	digest             func() hash.Hash
+	logger             LogFunc
+	verbosity          LogLevel
+	continueOnError    bool
+	dirMode            os.FileMode
+	fs                 FS
+	absolutePaths      AbsolutePathPolicy
+	skipAppleDouble    bool
+	skipEmpty          bool
+	skipUnchanged      bool
+	skipFileData       bool
+	safeParents        bool
+	stayOnDevice       bool
+	stayOnDeviceStrict bool
+	tee                io.Writer
+	concurrency        int
+	copyBufferSize     int
+	fallocate          bool
+	verify             map[string]string
+	verifyHash         func() hash.Hash
+	forceOwner         bool
+	skipSpecial        bool
+	skipSpecialStrict  bool
+	detectCase         bool
+	casePolicy         CaseCollisionPolicy
+	detectDuplicates   bool
+	duplicatePolicy    DuplicatePolicy
+	forceUid           int
+	forceGid           int
+	warn               func(err error)
+}
+
+// OverwritePolicy defines what an Extractor does with the existing files an
+// entry would overwrite. Existing directories are always merged with
+// directory entries.
+type OverwritePolicy int
+
+const (
+	// OverwriteReplace removes the existing file before extracting the
+	// entry. It's the default policy.
+	OverwriteReplace OverwritePolicy = iota
+	// OverwriteSkip leaves the existing file untouched and skips the
+	// entry.
+	OverwriteSkip
+	// OverwriteFail aborts the extraction.
+	OverwriteFail
+	// overwriteInPlace writes the regular files over the existing regular
+	// files, and aborts the extraction for the other entries, like
+	// ExtractTarInsecure always did without overwrite.
+	overwriteInPlace
+)
+
+// DeviceNodePolicy defines what an Extractor does with the character and
+// block device entries. Creating device nodes requires CAP_MKNOD.
+type DeviceNodePolicy int
+
+const (
+	// DeviceNodesCreate creates the device nodes. It's the default
+	// policy.
+	DeviceNodesCreate DeviceNodePolicy = iota
+	// DeviceNodesSkip skips the device entries.
+	DeviceNodesSkip
+	// DeviceNodesPlaceholder creates empty regular files in place of the
+	// device nodes, so their paths exist.
+	DeviceNodesPlaceholder
+)
+
+// AbsolutePathPolicy defines what an Extractor does with the entries whose
+// name, or hardlink target, is an absolute path.
+type AbsolutePathPolicy int
+
+const (
+	// AbsolutePathsStrip removes the leading slash, so the entries are
+	// extracted relative to the target directory like GNU tar does. It's
+	// the default policy.
+	AbsolutePathsStrip AbsolutePathPolicy = iota
+	// AbsolutePathsReject aborts the extraction with an
+	// InvalidNameError.
+	AbsolutePathsReject
+)
+
+// CaseCollisionPolicy defines what an Extractor does with the entries whose
+// path only differs in case from the one of an entry extracted earlier.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionFail aborts the extraction with a CaseCollisionError.
+	CaseCollisionFail CaseCollisionPolicy = iota
+	// CaseCollisionSkip skips the entry, logging it with the LogFunc.
+	CaseCollisionSkip
+)
+
+// DuplicatePolicy defines what an Extractor does with the entries whose path
+// is the one of an entry extracted earlier, with a different type.
+type DuplicatePolicy int
+
+const (
+	// DuplicateFail aborts the extraction with a DuplicateEntryError.
+	DuplicateFail DuplicatePolicy = iota
+	// DuplicateLastWins extracts the entry, replacing the earlier one
+	// according to the OverwritePolicy, and logs the DuplicateEntryError
+	// with the LogFunc.
+	DuplicateLastWins
+)
+
+// FsyncPolicy defines how an Extractor makes sure the extracted data is
+// written to disk.
+type FsyncPolicy int
+
+const (
+	// FsyncNone leaves it to the operating system. It's the default
+	// policy.
+	FsyncNone FsyncPolicy = iota
+	// FsyncEach calls fsync on every regular file once written, and on
+	// the directories containing the extracted entries at the end of the
+	// extraction. It's the most expensive policy, as every file waits for
+	// its data to reach the disk, but it only flushes the extracted data.
+	FsyncEach
+	// FsyncOnce calls sync at the end of the extraction. It's cheaper for
+	// big archives, but flushes the data of the whole system.
+	FsyncOnce
+)
+
+// LogFunc is called by an Extractor to log diagnostic messages, with
+// arguments in the manner of fmt.Printf.
+type LogFunc func(format string, args ...interface{})
+
+// LogLevel defines the messages logged by an Extractor.
+type LogLevel int
+
+const (
+	// LogNotices logs the skipped entries, the fallbacks and the
+	// permission errors ignored.
+	LogNotices LogLevel = iota + 1
+	// LogEntries also logs every entry extracted.
+	LogEntries
+)
+
+// ExtractedEntry describes an entry processed by an extraction.
+type ExtractedEntry struct {
+	// Name is the path of the entry, relative to the target directory
+	Name string
+	// Path is the path the entry was written at, in the target
+	// directory, once the options renaming the entries are applied. It's
+	// empty for the skipped entries and the whiteouts.
+	Path string
+	// Typeflag is the type of the entry
+	Typeflag byte
+	// Size is the size of the contents of the entry
+	Size int64
+	// Mode is the mode of the entry, as given by the header
+	Mode os.FileMode
+	// Uid and Gid are the owner of the entry, as given by the header
+	// or by WithForceOwner
+	Uid int
+	Gid int
+	// Skipped is true when the entry hasn't been extracted, because of
+	// the options of the Extractor
+	Skipped bool
+	// Digest is the hex encoded digest of the contents of a regular file,
+	// when the Extractor has been created with WithDigest
+	Digest string
+}
+
+// Stats counts the entries processed by extractions.
+type Stats struct {
+	// Files, Dirs, Symlinks and Hardlinks count the extracted entries
+	// of these types
+	Files     int
+	Dirs      int
+	Symlinks  int
+	Hardlinks int
+	// Devices counts the extracted character and block devices,
+	// including their placeholders
+	Devices int
+	// Fifos counts the extracted named pipes
+	Fifos int
+	// Whiteouts counts the whiteout markers applied, see WithWhiteouts
+	Whiteouts int
+	// Skipped counts the entries skipped because of the options of the
+	// Extractor
+	Skipped int
+	// BytesWritten is the size of the extracted regular files
+	BytesWritten int64
+	// BytesSkipped is the size of the contents of the skipped entries
+	BytesSkipped int64
+}
+
+// Option configures an Extractor.
+type Option func(*Extractor)
+
+// HeaderTransform is called with the header of every entry before it is
+// extracted. It can return a modified header that will be used for the
+// extraction, or a nil header to skip the entry. Custom PAX records are
+// available in the PAXRecords field of the header, and the size and times
+// recorded in PAX records have already replaced the ones of the legacy
+// header fields, which can't hold sizes of 8GiB and more or sub-second
+// times. Returning an error aborts the extraction.
+type HeaderTransform func(*tar.Header) (*tar.Header, error)
+
+// ProgressFunc is called during an extraction with the header of the entry
+// being extracted and the number of bytes written since the extraction
+// started.
+type ProgressFunc func(hdr *tar.Header, bytesWritten int64)
+
+// NewExtractor returns an Extractor configured with the given options.
+func NewExtractor(opts ...Option) *Extractor {
+	e := &Extractor{fs: osFS{}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// WithOverwrite sets the policy used for the existing files an entry would
+// overwrite.
+func WithOverwrite(policy OverwritePolicy) Option {
+	return func(e *Extractor) {
+		e.overwrite = policy
+	}
+}
+
+// WithWhitelist makes the Extractor extract only the paths in pwl.
+func WithWhitelist(pwl PathWhitelistMap) Option {
+	return func(e *Extractor) {
+		e.pwl = pwl
+	}
+}
+
+// WithPermissionsEditor sets a FilePermissionsEditor that is called after
+// every entry is extracted.
+func WithPermissionsEditor(editor FilePermissionsEditor) Option {
+	return func(e *Extractor) {
+		e.editor = editor
+	}
+}
+
+// WithUmask sets the umask applied to the modes of the extracted entries.
+// By default the umask of the process is used.
+//
+// The umask is global to the process, so it is changed only for the duration
+// of the extraction, and extractions from other Extractors in the process
+// wait for it to be restored. Other code changing the umask concurrently
+// isn't protected.
+func WithUmask(umask int) Option {
+	return func(e *Extractor) {
+		e.umask = umask
+		e.setUmask = true
+	}
+}
+
+// WithChown makes the Extractor set the owner of every extracted entry
+// (including directories, symlinks and device nodes) to the uid and gid
+// recorded in its header. If strict is false, failures due to missing
+// privileges (EPERM) are silently ignored and the entry keeps the owner of
+// the extracting process.
+func WithChown(strict bool) Option {
+	return func(e *Extractor) {
+		e.chown = true
+		e.chownStrict = strict
+	}
+}
+
+// WithPreserveTimes makes the Extractor restore the access and modification
+// times recorded in the headers of the extracted entries, symlinks included
+// where the platform supports it.
+func WithPreserveTimes() Option {
+	return func(e *Extractor) {
+		e.preserveTimes = true
+	}
+}
+
+// WithFixedTimes makes the Extractor set the access and modification times
+// of all the extracted entries to t, whatever the times recorded in their
+// headers, for reproducible extractions. It takes precedence over
+// WithPreserveTimes. The directories created without an entry keep the time
+// of their creation.
+func WithFixedTimes(t time.Time) Option {
+	return func(e *Extractor) {
+		e.fixedTimes = true
+		e.fixedTime = t
+	}
+}
+
+// WithXattrs makes the Extractor restore the extended attributes of the
+// extracted entries, stored in the Xattrs field or the SCHILY.xattr.* PAX
+// records of their headers. If strict is false, attributes are silently
+// dropped when the destination filesystem doesn't support them, or when
+// setting them requires missing privileges, like for trusted.* attributes.
+// The file capabilities, in security.capability, are restored with
+// CAP_SETFCAP, and skipped with a notice otherwise, even if strict is true.
+func WithXattrs(strict bool) Option {
+	return func(e *Extractor) {
+		e.xattrs = true
+		e.xattrsStrict = strict
+	}
+}
+
+// WithACLs makes the Extractor restore the POSIX ACLs of the extracted
+// entries, stored by GNU tar in the system.posix_acl_access and
+// system.posix_acl_default extended attributes, without WithXattrs. The ACLs
+// are set after the mode, which changes their mask. If strict is false, they
+// are dropped with a notice when the destination filesystem doesn't support
+// them. It takes precedence over the strictness of WithXattrs for the ACLs.
+func WithACLs(strict bool) Option {
+	return func(e *Extractor) {
+		e.acls = true
+		e.aclsStrict = strict
+	}
+}
+
+// WithFilter sets a function that is called with the header of every entry,
+// before anything is written. Entries for which it returns false are skipped.
+// Skipping a directory entry doesn't skip the entries inside it.
+func WithFilter(filter func(hdr *tar.Header) bool) Option {
+	return func(e *Extractor) {
+		e.filter = filter
+	}
+}
+
+// WithSkipAppleDouble makes the Extractor skip the AppleDouble files, whose
+// base name starts with "._", and the entries under the "__MACOSX" directory
+// found in the archives created on macOS.
+func WithSkipAppleDouble() Option {
+	return func(e *Extractor) {
+		e.skipAppleDouble = true
+	}
+}
+
+// WithSkipEmptyOverExisting makes the Extractor skip the empty regular files
+// that would replace an existing non-empty regular file, like one written by
+// a previous layer, instead of truncating it. The overwrite policy applies to
+// the other entries.
+func WithSkipEmptyOverExisting() Option {
+	return func(e *Extractor) {
+		e.skipEmpty = true
+	}
+}
+
+// WithSkipUnchanged makes the Extractor skip the regular files that would
+// replace an existing regular file of the same size and modification time,
+// which makes extracting again the same archive cheap. It's meant to be used
+// with WithPreserveTimes or WithFixedTimes, otherwise the existing files
+// don't have the modification times the extraction sets. The owner, mode and
+// extended attributes of the skipped files aren't restored. With WithVerify,
+// the digest of the existing file must also be the expected one, and files
+// that can't be read from the FS are written.
+func WithSkipUnchanged() Option {
+	return func(e *Extractor) {
+		e.skipUnchanged = true
+	}
+}
+
+// WithSkipFileData makes the Extractor create the regular files empty,
+// without writing their contents, to build the skeleton of a tree. Their
+// owner, mode, extended attributes and times are restored, and the other
+// entries are fully extracted. The contents are still read to compute the
+// digests of WithDigest and WithVerify.
+func WithSkipFileData() Option {
+	return func(e *Extractor) {
+		e.skipFileData = true
+	}
+}
+
+// WithSafeParents makes the Extractor refuse to write an entry, or to create
+// a hardlink to a file, through any symlink found in the target directory,
+// with an InsecureLinkError. By default only the symlinks created by the
+// extraction are refused, and the ones already in the target directory are
+// followed, which may write outside of it. The whiteouts of WithWhiteouts are
+// always refused through a symlink.
+func WithSafeParents() Option {
+	return func(e *Extractor) {
+		e.safeParents = true
+	}
+}
+
+// WithStayOnDevice makes the Extractor refuse to write the entries whose
+// path, or its nearest existing parent, isn't on the device of the target
+// directory, like a filesystem mounted inside it. If strict is true, the
+// extraction is aborted with a CrossDeviceError, otherwise the entries are
+// skipped with a notice. The devices aren't known on Windows, and on the FS
+// whose FileInfos don't come from the operating system, where it does
+// nothing.
+func WithStayOnDevice(strict bool) Option {
+	return func(e *Extractor) {
+		e.stayOnDevice = true
+		e.stayOnDeviceStrict = strict
+	}
+}
+
+// WithTee makes the Extractor write to w the bytes of the uncompressed
+// tarballs it reads from an io.Reader, with ExtractReader and
+// ExtractConcatenated, as they are extracted. The padding after the end of
+// the archive is copied too, so w receives an identical archive when the
+// extraction succeeds. An error writing to w aborts the extraction.
+func WithTee(w io.Writer) Option {
+	return func(e *Extractor) {
+		e.tee = w
+	}
+}
+
+// WithStripComponents makes the Extractor remove the first n elements from
+// the paths of the entries, and from the targets of hardlinks, like the
+// --strip-components option of GNU tar. Entries with n or fewer elements are
+// skipped. The whitelist and the filter see the original paths.
+func WithStripComponents(n int) Option {
+	return func(e *Extractor) {
+		e.strip = n
+	}
+}
+
+// WithHeaderTransform sets a HeaderTransform that is called for every entry
+// before it is extracted. It runs before the path and link checks, so
+// rewritten names and link targets are validated as well.
+func WithHeaderTransform(t HeaderTransform) Option {
+	return func(e *Extractor) {
+		e.transform = t
+	}
+}
+
+// WithProgress sets a ProgressFunc that is called after every entry has been
+// extracted, and periodically while copying the contents of regular files.
+func WithProgress(fn ProgressFunc) Option {
+	return func(e *Extractor) {
+		e.progress = fn
+	}
+}
+
+// WithMaxTotalBytes limits the number of bytes an extraction can write to n.
+// The contents actually read from the archive are counted, regardless of the
+// sizes in the headers, and the extraction is aborted with
+// ErrMaxBytesExceeded as soon as the limit is exceeded, also in the middle of
+// a file. A limit of zero or less disables the check.
+func WithMaxTotalBytes(n int64) Option {
+	return func(e *Extractor) {
+		e.maxBytes = n
+	}
+}
+
+// WithRename makes the Extractor call rename with the path of every entry,
+// after WithStripComponents is applied. The entry is extracted at the
+// returned path, or skipped if rename returns false. The targets of the
+// hardlinks are renamed too, and the entries whose target is skipped are
+// skipped. The absolute targets of the symlinks, which are rooted at the
+// target directory, are renamed without their leading slash, and kept as is
+// if rename returns false; the relative ones aren't modified.
+func WithRename(rename func(name string) (string, bool)) Option {
+	return func(e *Extractor) {
+		e.rename = rename
+	}
+}
+
+// WithMaxDepth limits the number of components of the paths of the entries
+// to n, so that "a/b/c" has a depth of 3. The names are checked as found in
+// the archive, before any filesystem operation, and the extraction is
+// aborted with ErrMaxDepthExceeded when the limit is exceeded. A limit of
+// zero or less disables the check.
+func WithMaxDepth(n int) Option {
+	return func(e *Extractor) {
+		e.maxDepth = n
+	}
+}
+
+// WithEntryTimeout limits the time the contents of every entry can be read
+// in to d, so that a stalled reader doesn't hang the extraction. Only the
+// reads count, not the time spent writing the contents. The extraction is
+// aborted with a TimeoutError once it's exceeded. The archive can't be read
+// anymore then, and the read in progress is left to complete in the
+// background. A timeout of zero or less disables the check.
+func WithEntryTimeout(d time.Duration) Option {
+	return func(e *Extractor) {
+		e.entryTimeout = d
+	}
+}
+
+// WithMaxEntries limits the number of entries an archive can contain to n.
+// All the entries are counted, including the skipped ones, and the
+// extraction is aborted with ErrMaxEntriesExceeded when the limit is
+// exceeded. A limit of zero or less disables the check.
+func WithMaxEntries(n int) Option {
+	return func(e *Extractor) {
+		e.maxEntries = n
+	}
+}
+
+// WithWhiteouts makes the Extractor apply the AUFS whiteout markers of image
+// layers instead of extracting them: a .wh.<name> entry removes <name> from
+// dir, and a .wh..wh..opq entry removes the contents of its directory that
+// aren't part of the archive. Directories marked with the overlayfs
+// trusted.overlay.opaque="y" extended attribute are handled like the ones
+// containing a .wh..wh..opq entry, and the attribute isn't restored. This
+// allows to extract layers on top of each other into the same directory.
+// A whiteout going through a symlink in dir, like one left by a lower layer,
+// is refused with an InsecureLinkError, as it could remove files outside of
+// dir.
+func WithWhiteouts() Option {
+	return func(e *Extractor) {
+		e.whiteouts = true
+	}
+}
+
+// WithSkipUnsupported makes the Extractor skip the entries whose type can't
+// be extracted instead of aborting. warn, if not nil, is called with the
+// UnsupportedTypeError of every skipped entry.
+func WithSkipUnsupported(warn func(err error)) Option {
+	return func(e *Extractor) {
+		e.skipUnsupported = true
+		e.warn = warn
+	}
+}
+
+// WithSkipSpecial makes the Extractor skip the fifo entries, and the ones
+// whose type can't be extracted like sockets, logging them with the LogFunc
+// (see WithLogger) instead of aborting. When strict is true, the fifo entries
+// abort the extraction with an UnsupportedTypeError instead, like the other
+// unsupported types.
+func WithSkipSpecial(strict bool) Option {
+	return func(e *Extractor) {
+		e.skipSpecial = true
+		e.skipSpecialStrict = strict
+	}
+}
+
+// WithDetectCaseCollisions makes the Extractor detect the entries whose path,
+// or one of its parents, only differs in case from the path of an entry
+// extracted earlier, and would overwrite it on a case-insensitive filesystem
+// as found on macOS and Windows. They are handled according to policy.
+func WithDetectCaseCollisions(policy CaseCollisionPolicy) Option {
+	return func(e *Extractor) {
+		e.detectCase = true
+		e.casePolicy = policy
+	}
+}
+
+// WithDetectDuplicates makes the Extractor detect the entries whose cleaned
+// path is the one of an entry extracted earlier, with a different type, like
+// a directory replacing a regular file. They are handled according to
+// policy. The entries replacing an entry of the same type are extracted, the
+// hardlinks count as regular files.
+func WithDetectDuplicates(policy DuplicatePolicy) Option {
+	return func(e *Extractor) {
+		e.detectDuplicates = true
+		e.duplicatePolicy = policy
+	}
+}
+
+// WithHardlinkFallback makes the Extractor copy the target of a hardlink when
+// it can't be linked because it's on another filesystem, like when dir
+// contains mount points. The copy keeps the mode, owner and times of the
+// target.
+func WithHardlinkFallback() Option {
+	return func(e *Extractor) {
+		e.hardlinkFallback = true
+	}
+}
+
+// WithDeviceNodes sets the policy used for the character and block device
+// entries, for example to extract a rootfs without privileges.
+func WithDeviceNodes(policy DeviceNodePolicy) Option {
+	return func(e *Extractor) {
+		e.deviceNodes = policy
+	}
+}
+
+// WithIDMapping makes the Extractor translate the uids and gids of the
+// entries through the given mappings, like the ones of a user namespace,
+// before they are used by WithChown or a FilePermissionsEditor. The entries
+// whose uid or gid isn't in any range are skipped. A nil mapping leaves the
+// ids unchanged.
+func WithIDMapping(uidMap, gidMap []IDMapRange) Option {
+	return func(e *Extractor) {
+		e.uidMap = uidMap
+		e.gidMap = gidMap
+	}
+}
+
+// WithSanitizeModes makes the Extractor clear the setuid and setgid bits of
+// every entry, and the sticky bit too when sticky is true, so an archive
+// extracted as root can't install a setuid binary. It applies to the modes
+// returned by a HeaderTransform.
+func WithSanitizeModes(sticky bool) Option {
+	return func(e *Extractor) {
+		e.sanitizeModes = true
+		e.sanitizeSticky = sticky
+	}
+}
+
+// WithStats makes the Extractor add the counts of the entries processed by
+// its extractions to stats. They're only counted once processed, so a
+// failed extraction leaves the counts of the entries preceding the error.
+func WithStats(stats *Stats) Option {
+	return func(e *Extractor) {
+		e.stats = stats
+	}
+}
+
+// WithManifest makes the Extractor append an ExtractedEntry to manifest for
+// every entry of the archive, with the name and header it was extracted
+// with. The hardlinks are appended after all the other entries, when they
+// are extracted.
+func WithManifest(manifest *[]ExtractedEntry) Option {
+	return func(e *Extractor) {
+		e.manifest = manifest
+	}
+}
+
+// WithDigest makes the Extractor compute the digest of every regular file
+// with a hash.Hash returned by hashFactory, while writing its contents. The
+// digests are reported in the ExtractedEntry of the files, see WithManifest.
+func WithDigest(hashFactory func() hash.Hash) Option {
+	return func(e *Extractor) {
+		e.digest = hashFactory
+	}
+}
+
+// WithLogger sets a LogFunc that is called with the messages up to the given
+// verbosity. Nothing is logged by default.
+func WithLogger(logger LogFunc, verbosity LogLevel) Option {
+	return func(e *Extractor) {
+		e.logger = logger
+		e.verbosity = verbosity
+	}
+}
+
+// WithContinueOnError makes the Extractor go on with the next entries when
+// one can't be extracted, and return a *MultiError with all the errors at the
+// end. Insecure or invalid entries, exceeded limits, truncated archives and
+// cancellations still abort the extraction.
+func WithContinueOnError() Option {
+	return func(e *Extractor) {
+		e.continueOnError = true
+	}
+}
+
+// WithDefaultDirMode sets the mode of the parent directories created for the
+// entries without a directory entry of their own, DefaultDirMode by
+// default. It must allow their owner to write in them. A later directory
+// entry for the same path sets its own mode.
+func WithDefaultDirMode(mode os.FileMode) Option {
+	return func(e *Extractor) {
+		e.dirMode = mode
+	}
+}
+
+// WithFS makes the Extractor create the entries in fs instead of the
+// filesystem of the operating system. WithStaging, WithWhiteouts, WithFsync,
+// WithHardlinkFallback and the FilePermissionsEditor still work on the
+// latter.
+func WithFS(fs FS) Option {
+	return func(e *Extractor) {
+		e.fs = fs
+	}
+}
+
+// minCopyBufferSize is the minimum size of the buffer set with
+// WithCopyBuffer.
+const minCopyBufferSize = 4096
+
+// WithCopyBuffer makes the Extractor copy the contents of the regular files
+// through a buffer of the given size, at least 4KiB, allocated once per
+// extraction. By default io.Copy decides.
+func WithCopyBuffer(size int) Option {
+	return func(e *Extractor) {
+		if size < minCopyBufferSize {
+			size = minCopyBufferSize
+		}
+		e.copyBufferSize = size
+	}
+}
+
+// WithFallocate makes the Extractor allocate the disk space of the regular
+// files before writing them, on Linux, which reduces fragmentation and fails
+// early when the disk is full. It's ignored on the filesystems without
+// support for it.
+func WithFallocate() Option {
+	return func(e *Extractor) {
+		e.fallocate = true
+	}
+}
+
+// WithVerify makes the Extractor compute the digest of every regular file
+// with a hash.Hash returned by hashFactory, and compare it to the hex encoded
+// digest in expected, keyed by the cleaned names of the files. The extraction
+// is aborted with a ChecksumMismatchError on the first file whose digest
+// differs, which may be already written, or that isn't in expected. It's also
+// returned at the end for the first missing file, in lexical order.
+func WithVerify(expected map[string]string, hashFactory func() hash.Hash) Option {
+	return func(e *Extractor) {
+		e.verify = expected
+		e.verifyHash = hashFactory
+	}
+}
+
+// WithConcurrency makes the Extractor write the regular files with n
+// goroutines, while the archive is read and the other entries are created in
+// order by the calling goroutine. The files are read in memory up to a limit,
+// the bigger ones are written by the calling goroutine. The
+// FilePermissionsEditor and the LogFunc can be called concurrently. A value
+// of n lower than 2 extracts sequentially, which is the default.
+func WithConcurrency(n int) Option {
+	return func(e *Extractor) {
+		e.concurrency = n
+	}
+}
+
+// WithForceOwner makes the Extractor ignore the owner of the entries, and
+// change the owner of all of them to uid and gid instead, like WithChown
+// would when it's permitted. It takes precedence over WithIDMapping. The ids
+// are also given to the FilePermissionsEditor and recorded in the manifest,
+// see WithManifest, to be applied later by unprivileged callers.
+func WithForceOwner(uid, gid int) Option {
+	return func(e *Extractor) {
+		e.forceOwner = true
+		e.forceUid = uid
+		e.forceGid = gid
+	}
+}
+
+// WithDryRun makes the Extractor go through the archive and validate it like
+// an extraction would, returning the same errors, without modifying dir or
+// anything else. The filesystem operations are recorded in memory instead,
+// on top of the existing contents of dir, so that for example the overwrite
+// policy applies to the files created earlier in the archive. Combined with
+// WithManifest, it gives a preview of an extraction. The errors that depend
+// on the filesystem itself, like missing permissions or space, aren't
+// detected. WithStaging, WithFsync and the FilePermissionsEditor are
+// ignored.
+func WithDryRun() Option {
+	return func(e *Extractor) {
+		e.dryRun = true
+	}
+}
+
+// WithChroot makes the Extractor extract in a thread chrooted into dir, so
+// that nothing out of dir can be reached, even through the symlinks already
+// in it. It's only supported on Linux, and requires the CAP_SYS_CHROOT
+// capability. The callbacks given to the other options run in the chroot
+// too, and the paths given to them are relative to it. WithConcurrency is
+// ignored, since the workers couldn't run in the chroot.
+func WithChroot() Option {
+	return func(e *Extractor) {
+		e.chroot = true
+	}
+}
+
+// WithStaging makes the Extractor extract into a temporary directory next to
+// dir, renamed to dir once the extraction succeeds, and removed otherwise.
+// dir is then either untouched or completely extracted. It must not exist or
+// be an empty directory.
+func WithStaging() Option {
+	return func(e *Extractor) {
+		e.staging = true
+	}
+}
+
+// WithAbsolutePaths sets the policy used for the entries with an absolute
+// path.
+func WithAbsolutePaths(policy AbsolutePathPolicy) Option {
+	return func(e *Extractor) {
+		e.absolutePaths = policy
+	}
+}
+
+// WithFsync sets the policy used to make sure the extracted data is written to
+// disk when the extraction returns.
+func WithFsync(policy FsyncPolicy) Option {
+	return func(e *Extractor) {
+		e.fsync = policy
+	}
+}
+
+// Extract extracts the tarball read from tr into dir.
+func (e *Extractor) Extract(tr *tar.Reader, dir string) error {
+	return e.ExtractContext(context.Background(), tr, dir)
+}
+
+// ExtractConcatenated extracts the concatenated tarballs read from r into
+// dir, like `tar --ignore-zeros` does, where archive/tar stops at the end of
+// the first tarball. The zero blocks padding a tarball are skipped, and the
+// data following them is read as the next tarball. The tarballs are
+// extracted as a single one: the symlinks created by a tarball are checked
+// for the entries of the following ones, and the directories and hardlinks
+// are completed at the end.
+func (e *Extractor) ExtractConcatenated(ctx context.Context, r io.Reader, dir string) error {
+	if e.tee != nil {
+		r = io.TeeReader(r, e.tee)
+	}
+	return e.extractContext(ctx, concatenatedTarballs(bufio.NewReader(r)), dir)
+}
+
+// ExtractContext extracts the tarball read from tr into dir. The extraction
+// is aborted, also in the middle of copying a file, when ctx is done.
+func (e *Extractor) ExtractContext(ctx context.Context, tr *tar.Reader, dir string) error {
+	return e.extractContext(ctx, singleTarball(tr), dir)
+}
+
+// nextTarball returns the reader of the next tarball to extract, or io.EOF
+// after the last one.
+type nextTarball func() (*tar.Reader, error)
+
+// singleTarball returns a nextTarball returning tr only.
+func singleTarball(tr *tar.Reader) nextTarball {
+	return func() (*tar.Reader, error) {
+		if tr == nil {
+			return nil, io.EOF
+		}
+		next := tr
+		tr = nil
+		return next, nil
+	}
+}
+
+// concatenatedTarballs returns a nextTarball reading the tarballs
+// concatenated in br, skipping the zero blocks between them.
+func concatenatedTarballs(br *bufio.Reader) nextTarball {
+	first := true
+	zero := make([]byte, blockSize)
+	return func() (*tar.Reader, error) {
+		if first {
+			first = false
+			return tar.NewReader(br), nil
+		}
+		// Skip the end of archive marker and the padding
+		for {
+			block, err := br.Peek(blockSize)
+			if len(block) == 0 && err == io.EOF {
+				return nil, io.EOF
+			}
+			if !bytes.Equal(block, zero[:len(block)]) {
+				return tar.NewReader(br), nil
+			}
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			br.Discard(blockSize)
+		}
+	}
+}
+
+// extractContext extracts the tarballs returned by next into dir.
+func (e *Extractor) extractContext(ctx context.Context, next nextTarball, dir string) error {
+	if e.dryRun {
+		return e.extractDryRun(ctx, next, dir)
+	}
+	if e.staging {
+		return e.extractStaged(ctx, next, dir)
+	}
+	if e.chroot {
+		return e.extractChroot(ctx, next, dir)
+	}
+	return e.extract(ctx, next, dir)
+}
+
+// extractDryRun goes through the tarballs returned by next as if they were
+// extracted into dir, on a dryRunFS.
+func (e *Extractor) extractDryRun(ctx context.Context, next nextTarball, dir string) error {
+	de := *e
+	de.fs = newDryRunFS(e.fs)
+	de.staging = false
+	de.fsync = FsyncNone
+	de.editor = nil
+	return de.extract(ctx, next, dir)
+}
+
+// extract extracts the tarballs returned by next into dir.
+func (e *Extractor) extract(ctx context.Context, next nextTarball, dir string) error {
+	umask, done := e.setupUmask()
+	defer done()
+
+	// The contents of the entries are read from the current tarball
+	tarball := &tarballReader{}
+	var body io.Reader = tarball
+	if ctx.Done() != nil {
+		body = &contextReader{ctx: ctx, r: body}
+	}
+	if e.maxBytes > 0 {
+		body = &limitReader{r: body, n: e.maxBytes}
+	}
+
+	x := &extraction{
+		Extractor: e,
+		dir:       dir,
+		body:      body,
+		symlinks:  make(map[string]struct{}),
+		extracted: make(map[string]struct{}),
+		dirs:      make(map[string]struct{}),
+		umask:     os.FileMode(umask) & os.ModePerm,
+	}
+	if e.concurrency > 1 {
+		x.pool = newWorkerPool(e.concurrency)
+		defer x.pool.close()
+	}
+	entries := 0
+	// last is the name of the last entry read
+	var last string
+Tar:
+	for {
+		if tarball.tr == nil {
+			tr, err := next()
+			if err == io.EOF {
+				break Tar
+			}
+			if err != nil {
+				return err
+			}
+			tarball.tr = tr
+		}
+		hdr, err := tarball.tr.Next()
+		switch err {
+		case io.EOF:
+			tarball.tr = nil
+		case nil:
+			last = hdr.Name
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, dir, err)
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				// archive/tar returns the global headers without
+				// merging them into the following entries
+				x.global = mergeGlobalRecords(x.global, hdr)
+				continue
+			}
+			if len(x.global) > 0 {
+				if hdr, err = applyGlobalRecords(hdr, x.global); err != nil {
+					return fmt.Errorf("could not extract file %q in %q: %w", last, dir, err)
+				}
+			}
+			entries++
+			if e.maxEntries > 0 && entries > e.maxEntries {
+				return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, dir, ErrMaxEntriesExceeded)
+			}
+			if e.maxDepth > 0 && pathDepth(hdr.Name) > e.maxDepth {
+				return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, dir, ErrMaxDepthExceeded)
+			}
+			if e.pwl != nil {
+				relpath := filepath.Clean(hdr.Name)
+				if _, ok := e.pwl[relpath]; !ok {
+					x.record(hdr, true)
+					continue
+				}
+			}
+			if e.filter != nil && !e.filter(hdr) {
+				x.record(hdr, true)
+				continue
+			}
+			if e.skipAppleDouble && isAppleDouble(hdr.Name) {
+				x.record(hdr, true)
+				continue
+			}
+			if e.strip > 0 {
+				h := stripHeader(hdr, e.strip)
+				if h == nil {
+					x.record(hdr, true)
+					continue
+				}
+				hdr = h
+			}
+			if e.rename != nil {
+				h := renameHeader(hdr, e.rename)
+				if h == nil {
+					x.record(hdr, true)
+					continue
+				}
+				hdr = h
+			}
+			if e.transform != nil {
+				h, err := e.transform(hdr)
+				if err != nil {
+					return err
+				}
+				if h == nil {
+					x.record(hdr, true)
+					continue
+				}
+				hdr = h
+			}
+			if e.forceOwner {
+				h := *hdr
+				h.Uid, h.Gid = e.forceUid, e.forceGid
+				hdr = &h
+			} else if e.uidMap != nil || e.gidMap != nil {
+				h := mapHeaderIDs(hdr, e.uidMap, e.gidMap)
+				if h == nil {
+					x.record(hdr, true)
+					continue
+				}
+				hdr = h
+			}
+			if e.sanitizeModes {
+				hdr = sanitizeMode(hdr, e.sanitizeSticky)
+			}
+			if e.whiteouts && (isWhiteout(hdr) || isOpaqueDir(hdr)) {
+				// They remove files, which must be written
+				if err := x.wait(); err != nil {
+					return err
+				}
+			}
+			if e.whiteouts && isWhiteout(hdr) {
+				if err := x.applyWhiteout(hdr); err != nil {
+					return fmt.Errorf("could not apply whiteout %q in %q: %w", hdr.Name, dir, err)
+				}
+				x.record(hdr, false)
+				continue
+			}
+			if e.whiteouts && isOpaqueDir(hdr) {
+				if err := x.applyOpaqueDir(hdr); err != nil {
+					return fmt.Errorf("could not apply opaque directory %q in %q: %w", hdr.Name, dir, err)
+				}
+				hdr = withoutOpaqueXattr(hdr)
+			}
+			// The target of a hardlink can come after it in the
+			// archive, so hardlinks are created once all the other
+			// entries are extracted.
+			if hdr.Typeflag == tar.TypeLink {
+				x.linkhdrs = append(x.linkhdrs, hdr)
+				continue
+			}
+			if err := x.extractEntry(hdr); err != nil {
+				if err := x.failed(err); err != nil {
+					return err
+				}
+			}
+			if x.pool != nil && !e.continueOnError && x.pool.failed() {
+				return x.wait()
+			}
+		case io.ErrUnexpectedEOF:
+			return &TruncatedArchiveError{Name: last, Err: err}
+		default:
+			return err
+		}
+	}
+
+	// The hardlinks targets, and the directories restored below, must be
+	// written
+	if err := x.wait(); err != nil {
+		return err
+	}
+	if e.verify != nil {
+		if err := x.checkVerified(); err != nil {
+			return err
+		}
+	}
+	for _, hdr := range x.linkhdrs {
+		if err := x.extractEntry(hdr); err != nil {
+			if err := x.failed(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch e.fsync {
+	case FsyncEach:
+		// Before restoring the modes, which may not allow to open
+		// the directories
+		if err := x.syncDirs(); err != nil {
+			return err
+		}
+	case FsyncOnce:
+		syncFilesystems()
+	}
+
+	if err := x.finishDirs(); err != nil {
+		return err
+	}
+	if len(x.errs) > 0 {
+		return &MultiError{Errors: x.errs}
+	}
+	return nil
+}
+
+// extractStaged extracts the tarballs returned by next into a staging
+// directory, renamed to dir on success.
+func (e *Extractor) extractStaged(ctx context.Context, next nextTarball, dir string) error {
+	mode := e.defaultDirMode()
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("%q is not a directory", dir)
+	default:
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return fmt.Errorf("staged extraction into %q: directory not empty", dir)
+		}
+		mode = info.Mode().Perm()
+	}
+
+	dir = filepath.Clean(dir)
+	staging, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".staging-")
+	if err != nil {
+		return err
+	}
+	se := *e
+	se.staging = false
+	if err := se.extractContext(ctx, next, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	// ioutil.TempDir creates the directory with mode 0700
+	if err := os.Chmod(staging, mode); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	// rename(2) replaces an empty directory
+	if err := os.Rename(staging, dir); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// extraction holds the state of a single extraction.
+type extraction struct {
+	*Extractor
+	dir  string
+	body io.Reader
+
+	// dirhdrs and linkhdrs are the headers of the directories and
+	// hardlinks whose extraction is completed at the end
+	dirhdrs  []*tar.Header
+	linkhdrs []*tar.Header
+	// written is the number of bytes written so far
+	written int64
+	// symlinks contains the paths of the symlinks created by the
+	// extraction, relative to dir and rooted at "/"
+	symlinks map[string]struct{}
+	// parents contains the directories checked by checkParents,
+	// relative to dir and rooted at "/"
+	parents map[string]struct{}
+	// umask is the umask used for the extraction
+	umask os.FileMode
+	// dirs contains the directories containing the extracted entries,
+	// when they're synced at the end
+	dirs map[string]struct{}
+	// folded maps the case-folded paths of the entries extracted so far,
+	// and of their parents, to the paths, rooted at "/"
+	folded map[string]string
+	// verified contains the names of the files verified so far, with
+	// WithVerify
+	verified map[string]struct{}
+	// dev is the device of dir, once devKnown is set by checkDevice
+	dev      uint64
+	devKnown bool
+	// seen maps the cleaned names of the entries extracted so far to
+	// their types, with WithDetectDuplicates
+	seen map[string]byte
+	// global contains the PAX records of the global headers read so far
+	global map[string]string
+	// buf is the buffer returned by copyBuffer
+	buf []byte
+	// pool writes the regular files of a concurrent extraction
+	pool *workerPool
+	// errs contains the errors of the entries that could not be
+	// extracted, with WithContinueOnError
+	errs []error
+	// sum is the digest of the last regular file extracted
+	sum string
+	// extracted contains the paths of the entries extracted so far,
+	// relative to dir and rooted at "/", when whiteouts are applied
+	extracted map[string]struct{}
+}
+
+// extractEntry extracts the entry described by hdr, whose contents are read
+// from x.body.
+func (x *extraction) extractEntry(hdr *tar.Header) error {
+	r := x.body
+	var pr *progressReader
+	if x.progress != nil {
+		pr = &progressReader{r: x.body, hdr: hdr, fn: x.progress, written: x.written}
+		r = pr
+	}
+	if x.entryTimeout > 0 {
+		tor := &timeoutReader{r: r, name: hdr.Name, timeout: x.entryTimeout, left: x.entryTimeout}
+		defer tor.close()
+		r = tor
+	}
+	if err := x.checkSymlinks(hdr); err != nil {
+		return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+	}
+	if x.safeParents {
+		if err := x.checkParents(hdr); err != nil {
+			return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+		}
+	}
+	if x.detectCase {
+		if err := x.checkCase(hdr); err != nil {
+			var cce *CaseCollisionError
+			if x.casePolicy == CaseCollisionSkip && errors.As(err, &cce) {
+				x.log(LogNotices, "%v", err)
+				x.record(hdr, true)
+				return nil
+			}
+			return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+		}
+	}
+	if x.stayOnDevice {
+		if err := x.checkDevice(hdr); err != nil {
+			var cde *CrossDeviceError
+			if !x.stayOnDeviceStrict && errors.As(err, &cde) {
+				x.log(LogNotices, "%v", err)
+				x.record(hdr, true)
+				return nil
+			}
+			return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+		}
+	}
+	if x.detectDuplicates {
+		if err := x.checkDuplicate(hdr); err != nil {
+			if x.duplicatePolicy != DuplicateLastWins {
+				return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+			}
+			x.log(LogNotices, "%v", err)
+		}
+	}
+	if x.pool != nil && x.pool.pending(filepath.Join(x.dir, hdr.Name), x.dir) {
+		// Replacing a file, or a directory containing files, or
+		// creating an entry inside a file, must happen once they're
+		// written
+		if err := x.wait(); err != nil {
+			return err
+		}
+	}
+	err := x.extractFile(r, x.dir, hdr)
+	skipped := err == errSkipped
+	if skipped {
+		err = nil
+	}
+	if err != nil {
+		var ute *UnsupportedTypeError
+		if (x.skipUnsupported || x.skipSpecial && !x.skipSpecialStrict) && errors.As(err, &ute) {
+			if x.warn != nil {
+				x.warn(err)
+			}
+			x.record(hdr, true)
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = &TruncatedArchiveError{Name: hdr.Name, Err: err}
+		}
+		return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		x.symlinks[rootedPath(hdr.Name)] = struct{}{}
+	case tar.TypeLink:
+		// A hardlink to a symlink is a symlink too, which the following
+		// hardlinks must not go through
+		info, err := x.fs.Lstat(filepath.Join(x.dir, hdr.Name))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			x.symlinks[rootedPath(hdr.Name)] = struct{}{}
+		}
+	}
+	if x.detectDuplicates && !skipped {
+		x.seen[filepath.Clean(hdr.Name)] = duplicateType(hdr.Typeflag)
+	}
+	if x.fsync == FsyncEach {
+		x.dirs[filepath.Dir(filepath.Join(x.dir, hdr.Name))] = struct{}{}
+	}
+	if x.whiteouts {
+		// Also record the parent directories, which may have been
+		// created without an entry of their own
+		root := string(filepath.Separator)
+		for p := rootedPath(hdr.Name); p != root; p = filepath.Dir(p) {
+			x.extracted[p] = struct{}{}
+		}
+	}
+	if pr != nil {
+		x.written = pr.written
+		x.progress(hdr, x.written)
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		x.dirhdrs = append(x.dirhdrs, hdr)
+	}
+	x.record(hdr, skipped)
+	return nil
+}
+
+// verifySum compares the digest computed by h for the regular file described
+// by hdr to the expected one.
+func (x *extraction) verifySum(hdr *tar.Header, h hash.Hash) error {
+	name := filepath.Clean(hdr.Name)
+	want := x.verify[name]
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return &ChecksumMismatchError{Name: name, Want: want, Got: got}
+	}
+	if x.verified == nil {
+		x.verified = make(map[string]struct{})
+	}
+	x.verified[name] = struct{}{}
+	return nil
+}
+
+// unchanged returns whether the existing file at p, described by info, has
+// the size and modification time of the regular file described by hdr, and
+// the expected digest when the files are verified.
+func (x *extraction) unchanged(p string, hdr *tar.Header, info os.FileInfo) (bool, error) {
+	_, mtime := x.entryTimes(hdr)
+	if !info.Mode().IsRegular() || info.Size() != hdr.Size || !info.ModTime().Equal(mtime) {
+		return false, nil
+	}
+	if x.verify == nil {
+		return true, nil
+	}
+	f, err := x.fs.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r, ok := f.(io.Reader)
+	if !ok {
+		return false, nil
+	}
+	h := x.verifyHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return false, err
+	}
+	if err := x.verifySum(hdr, h); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkVerified returns a ChecksumMismatchError for the first expected file
+// that hasn't been verified, if any.
+func (x *extraction) checkVerified() error {
+	var missing []string
+	for name := range x.verify {
+		if _, ok := x.verified[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &ChecksumMismatchError{Name: missing[0], Want: x.verify[missing[0]]}
+}
+
+// copyBuffer returns the buffer used to copy the contents of the regular
+// files, or nil when io.Copy decides.
+func (x *extraction) copyBuffer() []byte {
+	if x.copyBufferSize > 0 && x.buf == nil {
+		x.buf = make([]byte, x.copyBufferSize)
+	}
+	return x.buf
+}
+
+// wait waits for the regular files submitted to x.pool to be written, and
+// handles their errors like failed.
+func (x *extraction) wait() error {
+	if x.pool == nil {
+		return nil
+	}
+	for _, err := range x.pool.wait() {
+		if err := x.failed(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failed handles the error of an entry extraction. It returns the error when
+// it aborts the extraction, or nil when it's recorded to go on.
+func (x *extraction) failed(err error) error {
+	if !x.continueOnError || isFatal(err) {
+		return err
+	}
+	x.log(LogNotices, "%v", err)
+	x.errs = append(x.errs, err)
+	return nil
+}
+
+// record logs the entry described by hdr and appends it to the manifest, if
+// any.
+func (x *extraction) record(hdr *tar.Header, skipped bool) {
+	if skipped {
+		x.log(LogNotices, "skipped %q", hdr.Name)
+	} else {
+		x.log(LogEntries, "extracted %q", hdr.Name)
+	}
+	if x.stats != nil {
+		x.count(hdr, skipped)
+	}
+	if x.manifest == nil {
+		return
+	}
+	var p string
+	if !skipped && !(x.whiteouts && isWhiteout(hdr)) {
+		p = filepath.Join(x.dir, hdr.Name)
+	}
+	*x.manifest = append(*x.manifest, ExtractedEntry{
+		Name:     hdr.Name,
+		Path:     p,
+		Typeflag: hdr.Typeflag,
+		Size:     hdr.Size,
+		Mode:     hdr.FileInfo().Mode(),
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Skipped:  skipped,
+		Digest:   x.sum,
+	})
+	x.sum = ""
+}
+
+// count adds the entry described by hdr to x.stats.
+func (x *extraction) count(hdr *tar.Header, skipped bool) {
+	s := x.stats
+	if skipped {
+		s.Skipped++
+		s.BytesSkipped += hdr.Size
+		return
+	}
+	if x.whiteouts && isWhiteout(hdr) {
+		s.Whiteouts++
+		return
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		s.Files++
+		if !x.skipFileData {
+			s.BytesWritten += hdr.Size
+		}
+	case tar.TypeDir:
+		s.Dirs++
+	case tar.TypeSymlink:
+		s.Symlinks++
+	case tar.TypeLink:
+		s.Hardlinks++
+	case tar.TypeChar, tar.TypeBlock:
+		s.Devices++
+	case tar.TypeFifo:
+		s.Fifos++
+	}
+}
+
+// finishDirs restores the owner, mode, and atime and mtime of the extracted
+// directories. This has to be done after extracting as a file extraction will
+// change its parent directory's times, and would fail in a directory without
+// write permission. The deepest directories are restored first, the mode of
+// their parents may not allow to reach them. When a directory has several
+// entries, the last one is used.
+func (x *extraction) finishDirs() error {
+	last := make(map[string]int, len(x.dirhdrs))
+	for i, hdr := range x.dirhdrs {
+		last[filepath.Clean(hdr.Name)] = i
+	}
+	hdrs := make([]*tar.Header, 0, len(last))
+	for i, hdr := range x.dirhdrs {
+		if last[filepath.Clean(hdr.Name)] == i {
+			hdrs = append(hdrs, hdr)
+		}
+	}
+	sort.SliceStable(hdrs, func(i, j int) bool {
+		return pathDepth(hdrs[i].Name) > pathDepth(hdrs[j].Name)
+	})
+	for _, hdr := range hdrs {
+		p := filepath.Join(x.dir, hdr.Name)
+		fi := hdr.FileInfo()
+		if x.chown || x.forceOwner {
+			if err := x.lchown(p, hdr, fi); err != nil {
+				return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+			}
+		}
+		if err := x.fs.Chmod(p, x.mode(fi)); err != nil {
+			return fmt.Errorf("chmod %q: %w", p, err)
+		}
+		if x.xattrs || x.acls {
+			// The mode overwrote the mask of the ACL
+			if value, ok := headerXattrs(hdr)[aclAccessXattr]; ok {
+				if err := x.setXattr(p, aclAccessXattr, value); err != nil {
+					return err
+				}
+			}
+		}
+		if !x.preserveTimes && !x.fixedTimes {
+			continue
+		}
+		atime, mtime := x.entryTimes(hdr)
+		if err := x.fs.Lchtimes(p, atime, mtime); err != nil {
+			return fmt.Errorf("lchtimes %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// checkDevice returns a CrossDeviceError when the path of the entry described
+// by hdr, or its nearest existing parent, isn't on the device of dir.
+func (x *extraction) checkDevice(hdr *tar.Header) error {
+	if !x.devKnown {
+		dev, ok, err := x.nearestDevice(x.dir)
+		if !ok || err != nil {
+			return err
+		}
+		x.dev, x.devKnown = dev, true
+	}
+	p := filepath.Join(x.dir, hdr.Name)
+	dev, ok, err := x.nearestDevice(p)
+	if !ok || err != nil {
+		return err
+	}
+	if dev != x.dev {
+		return &CrossDeviceError{Name: hdr.Name, Path: p}
+	}
+	return nil
+}
+
+// nearestDevice returns the device of p, or of its nearest existing parent,
+// if it's known.
+func (x *extraction) nearestDevice(p string) (uint64, bool, error) {
+	for {
+		info, err := x.fs.Lstat(p)
+		if err == nil {
+			dev, ok := fileDevice(info)
+			return dev, ok, nil
+		}
+		if !os.IsNotExist(err) {
+			return 0, false, err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return 0, false, nil
+		}
+		p = parent
+	}
+}
+
+// checkDuplicate returns a DuplicateEntryError when an entry of another type
+// has been extracted earlier at the path of hdr.
+func (x *extraction) checkDuplicate(hdr *tar.Header) error {
+	if x.seen == nil {
+		x.seen = make(map[string]byte)
+	}
+	name := filepath.Clean(hdr.Name)
+	typ, ok := x.seen[name]
+	if !ok || typ == duplicateType(hdr.Typeflag) {
+		return nil
+	}
+	return &DuplicateEntryError{Name: name, Type: hdr.Typeflag, Existing: typ}
+}
+
+// duplicateType returns the type flag compared by checkDuplicate for the type
+// flag typ.
+func duplicateType(typ byte) byte {
+	switch typ {
+	case tar.TypeRegA, tar.TypeGNUSparse, tar.TypeLink:
+		return tar.TypeReg
+	}
+	return typ
+}
+
+// checkCase returns a CaseCollisionError when the path of hdr, or one of its
+// parents, only differs in case from a path extracted earlier. Otherwise the
+// path and its parents are recorded.
+func (x *extraction) checkCase(hdr *tar.Header) error {
+	if x.folded == nil {
+		x.folded = make(map[string]string)
+	}
+	root := string(filepath.Separator)
+	var paths []string
+	for p := rootedPath(hdr.Name); p != root; p = filepath.Dir(p) {
+		if existing, ok := x.folded[strings.ToLower(p)]; ok && existing != p {
+			return &CaseCollisionError{Name: hdr.Name, Existing: existing[1:]}
+		}
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		x.folded[strings.ToLower(p)] = p
+	}
+	return nil
+}
+
+// syncDirs calls fsync on the directories containing the extracted entries.
+func (x *extraction) syncDirs() error {
+	for dir := range x.dirs {
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return fmt.Errorf("could not sync %q: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Mode bits of the tar headers
+const (
+	c_ISUID = 04000
+	c_ISGID = 02000
+	c_ISVTX = 01000
+)
+
+// isAppleDouble returns whether name is an AppleDouble file or under the
+// "__MACOSX" directory.
+func isAppleDouble(name string) bool {
+	name = strings.TrimPrefix(rootedPath(name), string(filepath.Separator))
+	if name == "__MACOSX" || strings.HasPrefix(name, "__MACOSX"+string(filepath.Separator)) {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(name), "._")
+}
+
+// sanitizeMode returns a copy of hdr without the setuid and setgid bits, and
+// without the sticky bit when sticky is true.
+func sanitizeMode(hdr *tar.Header, sticky bool) *tar.Header {
+	h := *hdr
+	h.Mode &^= c_ISUID | c_ISGID
+	if sticky {
+		h.Mode &^= c_ISVTX
+	}
+	return &h
+}
+
+// checkSymlinks returns an error if the path of the entry described by hdr,
+// or the target of a hardlink, goes through a symlink created earlier in the
+// extraction, including the hardlinks to a symlink. Otherwise an archive
+// could plant a symlink pointing outside of dir and write the following
+// entries through it. Only the symlinks created by the archive are known:
+// the paths aren't resolved with O_NOFOLLOW, so this doesn't protect against
+// the symlinks created or changed concurrently by another process.
+func (x *extraction) checkSymlinks(hdr *tar.Header) error {
+	if len(x.symlinks) == 0 {
+		return nil
+	}
+	names := []string{hdr.Name}
+	if hdr.Typeflag == tar.TypeLink {
+		names = append(names, hdr.Linkname)
+	}
+	for _, name := range names {
+		root := string(filepath.Separator)
+		for parent := filepath.Dir(rootedPath(name)); parent != root; parent = filepath.Dir(parent) {
+			if _, ok := x.symlinks[parent]; !ok {
+				continue
+			}
+			// The symlink may have been replaced since
+			info, err := x.fs.Lstat(filepath.Join(x.dir, parent))
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				delete(x.symlinks, parent)
+				continue
+			}
+			return &InsecureLinkError{Path: name, Link: parent[1:]}
+		}
+	}
+	return nil
+}
+
+// checkParents returns an error if the path of the entry described by hdr,
+// or the target of a hardlink, goes through a symlink in dir, see
+// WithSafeParents. The directories found are recorded, the ones replaced by
+// a symlink later are caught by checkSymlinks.
+func (x *extraction) checkParents(hdr *tar.Header) error {
+	if x.parents == nil {
+		x.parents = make(map[string]struct{})
+	}
+	names := []string{hdr.Name}
+	if hdr.Typeflag == tar.TypeLink {
+		names = append(names, hdr.Linkname)
+	}
+	for _, name := range names {
+		// Check from the top, the missing directories are created
+		// by the extraction
+		var parents []string
+		root := string(filepath.Separator)
+		for parent := filepath.Dir(rootedPath(name)); parent != root; parent = filepath.Dir(parent) {
+			parents = append(parents, parent)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			parent := parents[i]
+			if _, ok := x.parents[parent]; ok {
+				continue
+			}
+			info, err := x.fs.Lstat(filepath.Join(x.dir, parent))
+			if os.IsNotExist(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return &InsecureLinkError{Path: name, Link: parent[1:]}
+			}
+			x.parents[parent] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// stripHeader returns a copy of hdr with the first n elements removed from
+// its name and, for hardlinks, its link target. It returns nil if nothing is
+// left of them.
+func stripHeader(hdr *tar.Header, n int) *tar.Header {
+	h := *hdr
+	if h.Name = stripComponents(h.Name, n); h.Name == "" {
+		return nil
+	}
+	if h.Typeflag == tar.TypeLink {
+		if h.Linkname = stripComponents(h.Linkname, n); h.Linkname == "" {
+			return nil
+		}
+	}
+	return &h
+}
+
+// renameHeader returns a copy of hdr with its name and link target renamed
+// with rename, see WithRename. It returns nil if the entry is skipped.
+func renameHeader(hdr *tar.Header, rename func(string) (string, bool)) *tar.Header {
+	h := *hdr
+	var ok bool
+	if h.Name, ok = rename(hdr.Name); !ok {
+		return nil
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		if h.Linkname, ok = rename(hdr.Linkname); !ok {
+			return nil
+		}
+	case tar.TypeSymlink:
+		if strings.HasPrefix(hdr.Linkname, "/") {
+			if name, ok := rename(strings.TrimLeft(hdr.Linkname, "/")); ok {
+				h.Linkname = "/" + name
+			}
+		}
+	}
+	return &h
+}
+
+// stripComponents removes the first n elements from the slash separated
+// name. Leading and repeated slashes don't count as elements.
+func stripComponents(name string, n int) string {
+	name = strings.TrimLeft(name, "/")
+	for ; n > 0; n-- {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return ""
+		}
+		name = strings.TrimLeft(name[i+1:], "/")
+	}
+	return name
+}
+
+// pathDepth returns the number of components of the cleaned name.
+func pathDepth(name string) int {
+	p := rootedPath(name)
+	if p == string(filepath.Separator) {
+		return 0
+	}
+	return strings.Count(p, string(filepath.Separator))
+}
+
+// rootedPath returns the cleaned name, rooted at "/".
+func rootedPath(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
+
+// mode returns the mode of fi with the extraction umask applied.
+func (x *extraction) mode(fi os.FileInfo) os.FileMode {
+	return fi.Mode() &^ x.umask
+}
+
+// lchown sets the owner of the entry at p to the uid and gid in hdr.
+func (x *extraction) lchown(p string, hdr *tar.Header, fi os.FileInfo) error {
+	if err := x.fs.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+		if !x.chownStrict && isPermissionError(err) {
+			x.log(LogNotices, "could not change the owner of %q: %v", p, err)
+			return nil
+		}
+		return err
+	}
+
+	// lchown(2) says that, depending on the linux kernel version, it
+	// can change the file's mode also if executed as root. So call
+	// os.Chmod after it. Directories modes are restored at the end of the
+	// extraction.
+	if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeDir {
+		if err := x.fs.Chmod(p, x.mode(fi)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setXattrs sets on p the extended attributes recorded in the Xattrs field
+// and the PAX records of hdr. The ACLs are set last, once the mode is set.
+func (e *Extractor) setXattrs(p string, hdr *tar.Header) error {
+	xattrs := headerXattrs(hdr)
+	if e.xattrs {
+		for name, value := range xattrs {
+			if isACLXattr(name) {
+				continue
+			}
+			if err := e.setXattr(p, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		// Symlinks don't have ACLs
+		return nil
+	}
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		if value, ok := xattrs[name]; ok {
+			if err := e.setXattr(p, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setXattr sets the extended attribute name of p to value, ignoring the
+// errors allowed by the strictness of the options.
+func (e *Extractor) setXattr(p, name, value string) error {
+	err := ErrNotSupportedPlatform
+	if xfs, ok := e.fs.(XattrFS); ok {
+		err = xfs.Lsetxattr(p, name, []byte(value))
+	}
+	if err == nil {
+		return nil
+	}
+	if name == capabilityXattr && err == syscall.EPERM {
+		e.log(LogNotices, "could not restore the file capabilities of %q: %v", p, err)
+		return nil
+	}
+	strict := e.xattrsStrict
+	if isACLXattr(name) && e.acls {
+		strict = e.aclsStrict
+	}
+	if !strict && (err == syscall.ENOTSUP || err == syscall.EPERM || err == ErrNotSupportedPlatform) {
+		e.log(LogNotices, "could not set xattr %q on %q: %v", name, p, err)
+		return nil
+	}
+	return fmt.Errorf("failed to set xattr %q: %v", name, err)
+}
+
+// headerXattrs returns the extended attributes recorded in the Xattrs field
+// and the PAX records of hdr.
+func headerXattrs(hdr *tar.Header) map[string]string {
+	// archive/tar fills both from the PAX records, but headers modified by
+	// a HeaderTransform may only have one of them
+	xattrs := make(map[string]string, len(hdr.Xattrs))
+	for name, value := range hdr.Xattrs {
+		xattrs[name] = value
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxSchilyXattr) {
+			xattrs[strings.TrimPrefix(key, paxSchilyXattr)] = value
+		}
+	}
+	return xattrs
+}
+
+// isACLXattr returns whether the extended attribute name holds POSIX ACLs.
+func isACLXattr(name string) bool {
+	return name == aclAccessXattr || name == aclDefaultXattr
+}
+
+// entryTimes returns the access and modification times set on the entry
+// described by hdr.
+func (e *Extractor) entryTimes(hdr *tar.Header) (time.Time, time.Time) {
+	if e.fixedTimes {
+		return e.fixedTime, e.fixedTime
+	}
+	return hdrTimes(hdr)
+}
+
+// defaultDirMode returns the mode of the directories created without an
+// entry.
+func (e *Extractor) defaultDirMode() os.FileMode {
+	if e.dirMode != 0 {
+		return e.dirMode
+	}
+	return DefaultDirMode
+}
+
+// log calls the LogFunc of e when the verbosity allows for level.
+func (e *Extractor) log(level LogLevel, format string, args ...interface{}) {
+	if e.logger != nil && level <= e.verbosity {
+		e.logger(format, args...)
+	}
+}
+
+// umaskMu protects the process umask during extractions. Extractions with a
+// custom umask hold it exclusively while it's changed, the others share it
+// so the process umask doesn't change under them.
+var umaskMu sync.RWMutex
+
+// setupUmask sets up the process umask for an extraction. It returns the
+// umask applied during the extraction and a function to call once it's
+// finished.
+func (e *Extractor) setupUmask() (int, func()) {
+	// The umask can only be read by changing it
+	umaskMu.Lock()
+	if e.setUmask {
+		prev := setProcessUmask(e.umask)
+		return e.umask, func() {
+			setProcessUmask(prev)
+			umaskMu.Unlock()
+		}
+	}
+	umask := setProcessUmask(0)
+	setProcessUmask(umask)
+	umaskMu.Unlock()
+	umaskMu.RLock()
+	return umask, umaskMu.RUnlock
+}
+
+// tarballReader is an io.Reader reading the contents of the current entry of
+// tr, the tarball being extracted.
+type tarballReader struct {
+	tr *tar.Reader
+}
+
+func (r *tarballReader) Read(p []byte) (int, error) {
+	return r.tr.Read(p)
+}
+
+// contextReader is an io.Reader failing with the context error once the
+// context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// timeoutReader is an io.Reader failing with a TimeoutError once its reads
+// have taken longer than the timeout, also while a read is blocked. Only the
+// time spent in Read counts, not the time spent writing what was read. The
+// reads are made by a goroutine started by the first Read, into a buffer of
+// its own since it can keep reading after a timeout. close stops it.
+type timeoutReader struct {
+	r       io.Reader
+	name    string
+	timeout time.Duration
+	// left is the time the reads can still take
+	left   time.Duration
+	failed bool
+	// reqs sends the size of every read to the goroutine, which answers
+	// on results
+	reqs    chan int
+	results chan readResult
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.failed || r.left <= 0 {
+		r.failed = true
+		return 0, &TimeoutError{Name: r.name, Timeout: r.timeout}
+	}
+	if r.reqs == nil {
+		r.reqs = make(chan int)
+		// Buffered, so a read completing after a timeout doesn't
+		// block the goroutine
+		r.results = make(chan readResult, 1)
+		go r.read()
+	}
+	start := time.Now()
+	r.reqs <- len(p)
+	timer := time.NewTimer(r.left)
+	defer timer.Stop()
+	select {
+	case res := <-r.results:
+		r.left -= time.Since(start)
+		return copy(p, res.buf), res.err
+	case <-timer.C:
+		r.failed = true
+		return 0, &TimeoutError{Name: r.name, Timeout: r.timeout}
+	}
+}
+
+// read makes the reads requested on r.reqs, until it's closed.
+func (r *timeoutReader) read() {
+	var buf []byte
+	for size := range r.reqs {
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		n, err := r.r.Read(buf[:size])
+		r.results <- readResult{buf: buf[:n], err: err}
+	}
+}
+
+// close stops the goroutine reading for r, once the read in progress, if any,
+// completes.
+func (r *timeoutReader) close() {
+	if r.reqs != nil {
+		close(r.reqs)
+		r.reqs = nil
+	}
+}
+
+// limitReader is an io.Reader failing with ErrMaxBytesExceeded once more
+// than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, ErrMaxBytesExceeded
+	}
+	// Read one more byte than allowed to detect the limit is exceeded
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return 0, ErrMaxBytesExceeded
+	}
+	return n, err
+}
+
+// progressReader is an io.Reader reporting the bytes read so far to a
+// ProgressFunc.
+type progressReader struct {
+	r       io.Reader
+	hdr     *tar.Header
+	fn      ProgressFunc
+	written int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.written += int64(n)
+		r.fn(r.hdr, r.written)
+	}
+	return n, err
+}
+
+// copyFile copies the regular file src to the new file dst, with its mode,
+// owner and times.
+func copyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot copy %q: not a regular file", src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			return err
+		}
+	}
+	// Restore the mode after chown, like in lchown
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	// The access time isn't portably available, use the modification time
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func isCrossDeviceError(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.EXDEV
+}
+
+func isPermissionError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EPERM
+}
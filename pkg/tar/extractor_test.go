@@ -0,0 +1,4780 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+)
+
+func TestExtractorChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("chown requires root. Disabling test.")
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Uid:      1000,
+				Gid:      1001,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(04755),
+				Uid:  1002,
+				Gid:  1003,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				Uid:      1004,
+				Gid:      1005,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/null",
+				Typeflag: tar.TypeChar,
+				Devmajor: 1,
+				Devminor: 3,
+				Uid:      1006,
+				Gid:      1007,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithChown(true)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, entry := range entries {
+		wantUid, wantGid := entry.header.Uid, entry.header.Gid
+		p := filepath.Join(tmpdir, entry.header.Name)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if int(st.Uid) != wantUid || int(st.Gid) != wantGid {
+			t.Errorf("%s: wrong owner, wanted %d:%d, got %d:%d", entry.header.Name, wantUid, wantGid, st.Uid, st.Gid)
+		}
+	}
+
+	// chown clears the setuid bit, check it has been restored
+	info, err := os.Stat(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit lost after chown, mode: %s", info.Mode())
+	}
+}
+
+func TestExtractorPreserveTimes(t *testing.T) {
+	// Do not set ns as tar has second precision
+	time1 := time.Unix(100000, 0)
+	time2 := time.Unix(200000, 0)
+	time3 := time.Unix(300000, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  time1,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:       "folder/foo.txt",
+				Size:       3,
+				ModTime:    time2,
+				AccessTime: time3,
+				Format:     tar.FormatPAX,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name:    "folder/bar.txt",
+				Size:    3,
+				ModTime: time3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithPreserveTimes()), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tt := range []struct {
+		path  string
+		atime time.Time
+		mtime time.Time
+	}{
+		{"folder", time1, time1},
+		{"folder/foo.txt", time3, time2},
+		// no access time in the header, mtime is used
+		{"folder/bar.txt", time3, time3},
+	} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(tmpdir, tt.path), &st); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+		mtime := time.Unix(int64(st.Mtim.Sec), int64(st.Mtim.Nsec))
+		if !atime.Equal(tt.atime) {
+			t.Errorf("%s: wrong atime, wanted %s, got %s", tt.path, tt.atime, atime)
+		}
+		if !mtime.Equal(tt.mtime) {
+			t.Errorf("%s: wrong mtime, wanted %s, got %s", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	// Without the option the current time is kept
+	tmpdir2, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(tmpdir2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkTime(filepath.Join(tmpdir2, "folder/foo.txt"), time2); err == nil {
+		t.Errorf("unexpected restored mtime without WithPreserveTimes")
+	}
+}
+
+func TestExtractorPAXXattrs(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.user.rkt": "value",
+					"RKT.custom":            "custom",
+				},
+			},
+		},
+	}
+	var records map[string]string
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		records = hdr.PAXRecords
+		return hdr, nil
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithXattrs(true), WithHeaderTransform(transform)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		if strings.Contains(err.Error(), syscall.ENOTSUP.Error()) {
+			t.Skipf("xattrs not supported on %s. Disabling test.", tmpdir)
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records["RKT.custom"] != "custom" {
+		t.Errorf("custom PAX record not passed to the header transform, got: %v", records)
+	}
+
+	value, err := fileutil.Lgetxattr(filepath.Join(tmpdir, "foo.txt"), "user.rkt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(value) != "value" {
+		t.Errorf("unexpected xattr value, wanted: %q, got: %q", "value", value)
+	}
+}
+
+func TestExtractorLeakedGNULongName(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	// archive/tar never returns these entries, simulate one leaking
+	// through
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Typeflag = tar.TypeGNULongName
+		return hdr, nil
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithHeaderTransform(transform)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarContext(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: strings.Repeat("b", 1<<20),
+			header: &tar.Header{
+				Name: "big.txt",
+				Size: 1 << 20,
+			},
+		},
+	}
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Cancel the context while the big file is being copied
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	tr := tar.NewReader(&cancelingReader{r: containerTar, cancel: cancel, after: 64 << 10})
+	err = ExtractTarContext(ctx, tr, tmpdir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "big.txt") {
+		t.Errorf("expected the error to name the interrupted entry, got: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(tmpdir, "big.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Size() == 1<<20 {
+		t.Errorf("big.txt fully extracted despite cancellation")
+	}
+
+	// An already canceled context doesn't extract anything
+	if _, err := containerTar.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir2, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir2)
+	if err := ExtractTarContext(ctx, tar.NewReader(containerTar), tmpdir2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled error, got: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir2, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// cancelingReader calls cancel once more than after bytes have been read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+	after  int
+	read   int
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	if r.read > r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestExtractorProgress(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: strings.Repeat("b", 1<<20),
+			header: &tar.Header{
+				Name: "folder/big.txt",
+				Size: 1 << 20,
+			},
+		},
+	}
+	var (
+		calls    int
+		lastName string
+		lastSize int64
+	)
+	progress := func(hdr *tar.Header, bytesWritten int64) {
+		if hdr == nil {
+			t.Fatalf("progress called with a nil header")
+		}
+		if bytesWritten < lastSize {
+			t.Errorf("bytes written decreased from %d to %d", lastSize, bytesWritten)
+		}
+		calls++
+		lastName = hdr.Name
+		lastSize = bytesWritten
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithProgress(progress)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lastName != "folder/big.txt" {
+		t.Errorf("unexpected last reported entry: %q", lastName)
+	}
+	if lastSize != 3+1<<20 {
+		t.Errorf("unexpected bytes written, wanted: %d, got: %d", 3+1<<20, lastSize)
+	}
+	// big.txt must have been reported while being copied
+	if calls <= len(entries)+1 {
+		t.Errorf("expected incremental progress, got %d calls", calls)
+	}
+}
+
+func TestExtractorFilter(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "dev/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "dev/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "etc/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "etc/bar.conf",
+				Size: 3,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "etc/baz.txt",
+				Size: 3,
+			},
+		},
+	}
+	// Skip dev/ and everything in it, and keep only *.conf files from
+	// other directories
+	filter := func(hdr *tar.Header) bool {
+		name := filepath.Clean(hdr.Name)
+		if name == "dev" || strings.HasPrefix(name, "dev/") {
+			return false
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			return true
+		}
+		match, _ := filepath.Match("*/*.conf", name)
+		return match
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithFilter(filter)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/bar.conf", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorOverwrite(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	for _, tt := range []struct {
+		policy   OverwritePolicy
+		err      bool
+		contents string
+	}{
+		{OverwriteReplace, false, "foo"},
+		{OverwriteSkip, false, "previous contents"},
+		{OverwriteFail, true, "previous contents"},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		p := filepath.Join(tmpdir, "foo.txt")
+		if err := ioutil.WriteFile(p, []byte("previous contents"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = extractEntriesInto(t, NewExtractor(WithOverwrite(tt.policy)), entries, tmpdir)
+		if tt.err != (err != nil) {
+			t.Errorf("policy %d: unexpected error: %v", tt.policy, err)
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != tt.contents {
+			t.Errorf("policy %d: unexpected contents, wanted: %q, got: %q", tt.policy, tt.contents, buf)
+		}
+		if tt.err {
+			continue
+		}
+
+		// Extracting again only touches existing files
+		if err := extractEntriesInto(t, NewExtractor(WithOverwrite(tt.policy)), entries, tmpdir); err != nil {
+			t.Errorf("policy %d: unexpected error: %v", tt.policy, err)
+		}
+	}
+}
+
+func TestExtractorOverwriteSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "keep"), []byte("keep"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dirlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	for _, tt := range []struct {
+		policy OverwritePolicy
+		err    bool
+		link   string
+	}{
+		{OverwriteReplace, false, "foo.txt"},
+		{OverwriteSkip, false, "previous.txt"},
+		{OverwriteFail, true, "previous.txt"},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		// Left by a previous extraction, dirlink points to a directory
+		// whose contents must not be removed
+		if err := os.Symlink("previous.txt", filepath.Join(tmpdir, "link")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.Symlink(outside, filepath.Join(tmpdir, "dirlink")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = extractEntriesInto(t, NewExtractor(WithOverwrite(tt.policy)), entries, tmpdir)
+		if tt.err != (err != nil) {
+			t.Errorf("policy %d: unexpected error: %v", tt.policy, err)
+		}
+		target, err := os.Readlink(filepath.Join(tmpdir, "link"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if target != tt.link {
+			t.Errorf("policy %d: unexpected symlink target %q", tt.policy, target)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+			t.Errorf("policy %d: the contents of the symlinked directory were removed: %v", tt.policy, err)
+		}
+	}
+}
+
+func TestExtractorSymlinkOverDirectory(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "full",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "target",
+			},
+		},
+	}
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.MkdirAll(filepath.Join(tmpdir, "full/sub"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "full/sub/keep"), []byte("keep"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A non-empty directory isn't wiped by a symlink
+	if err := extractEntriesInto(t, NewExtractor(WithOverwrite(OverwriteReplace)), entries, tmpdir); err == nil {
+		t.Errorf("expected an error replacing a non-empty directory")
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "full/sub/keep")); err != nil {
+		t.Errorf("the contents of the directory were removed: %v", err)
+	}
+	// Which a dry run predicts
+	if err := extractEntriesInto(t, NewExtractor(WithOverwrite(OverwriteReplace), WithDryRun()), entries, tmpdir); err == nil {
+		t.Errorf("dry run: expected an error replacing a non-empty directory")
+	}
+
+	// An empty one is replaced
+	entries[0].header.Name = "empty"
+	if err := os.Mkdir(filepath.Join(tmpdir, "empty"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := extractEntriesInto(t, NewExtractor(WithOverwrite(OverwriteReplace)), entries, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(tmpdir, "empty")); err != nil || target != "target" {
+		t.Errorf("expected the directory to be replaced by the symlink, got %q: %v", target, err)
+	}
+
+	// The existing entry is removed alone
+	fs := newFakeFS()
+	if err := mkdirAll(fs, "/fake", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := fs.create("/fake/empty", 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs.ops = nil
+	e := NewExtractor(WithFS(fs), WithOverwrite(OverwriteReplace))
+	if err := e.Extract(tar.NewReader(bytes.NewReader(readTestTar(t, entries))), "/fake"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fs.ops) == 0 || fs.ops[0] != "remove /fake/empty" {
+		t.Errorf("expected the file to be removed with Remove, got: %q", fs.ops)
+	}
+}
+
+func TestExtractorInsecurePaths(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// A sibling of tmpdir sharing its name as prefix
+	sibling := "../" + filepath.Base(tmpdir) + "-evil"
+	defer os.RemoveAll(filepath.Join(tmpdir, sibling))
+
+	for _, hdr := range []*tar.Header{
+		{Name: "../foo.txt", Typeflag: tar.TypeReg},
+		{Name: "folder/../../foo.txt", Typeflag: tar.TypeReg},
+		{Name: sibling + "/foo.txt", Typeflag: tar.TypeReg},
+		{Name: "../folder", Typeflag: tar.TypeDir},
+		{Name: "symlink", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+		{Name: "folder/symlink", Typeflag: tar.TypeSymlink, Linkname: "../" + sibling},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../foo.txt"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: sibling + "/foo.txt"},
+	} {
+		entries := []*testTarEntry{{header: hdr}}
+		name, linkname := hdr.Name, hdr.Linkname
+		if err := extractEntriesInto(t, NewExtractor(), entries, tmpdir); err == nil {
+			t.Errorf("%q -> %q: expected an error", name, linkname)
+		}
+		if err := checkExpectedFiles(tmpdir, nil); err != nil {
+			t.Errorf("%q -> %q: unexpected error: %v", name, linkname, err)
+		}
+		if _, err := os.Lstat(filepath.Join(tmpdir, sibling)); err == nil {
+			t.Fatalf("%q -> %q: file created outside of the target directory", name, linkname)
+		}
+	}
+
+	// Links that stay inside the directory are fine
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/../folder/foo.txt",
+			},
+		},
+	}
+	if err := extractEntriesInto(t, NewExtractor(), entries, tmpdir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorRelativeDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Chdir(wd)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "folder/symlink", typeflag: tar.TypeSymlink},
+	}
+	for _, dir := range []string{".", "./"} {
+		for _, tt := range []struct {
+			name    string
+			extract func(tr *tar.Reader, dir string) error
+		}{
+			{"Extractor", NewExtractor().Extract},
+			{"ExtractTarInsecure", func(tr *tar.Reader, dir string) error {
+				return ExtractTarInsecure(tr, dir, false, nil, nil)
+			}},
+		} {
+			tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := tt.extract(tar.NewReader(bytes.NewReader(readTestTar(t, entries))), dir); err != nil {
+				t.Errorf("%s in %q: unexpected error: %v", tt.name, dir, err)
+			}
+			if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+				t.Errorf("%s in %q: unexpected error: %v", tt.name, dir, err)
+			}
+
+			// The paths outside of it are still refused
+			evil := []*testTarEntry{{header: &tar.Header{Name: "../foo.txt", Typeflag: tar.TypeReg}}}
+			var ipe *InsecurePathError
+			if err := tt.extract(tar.NewReader(bytes.NewReader(readTestTar(t, evil))), dir); !errors.As(err, &ipe) {
+				t.Errorf("%s in %q: expected an InsecurePathError, got %v", tt.name, dir, err)
+			}
+		}
+	}
+}
+
+func TestExtractorInsecurePathError(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, hdr := range []*tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "./../folder/", Typeflag: tar.TypeDir},
+		{Name: "dev/../../null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+		{Name: "dev/../../loop0", Typeflag: tar.TypeBlock, Devmajor: 7},
+		{Name: "../run/fifo", Typeflag: tar.TypeFifo},
+		{Name: "../symlink", Typeflag: tar.TypeSymlink, Linkname: "foo"},
+		{Name: "../hardlink", Typeflag: tar.TypeLink, Linkname: "foo"},
+	} {
+		name := hdr.Name
+		err := extractEntriesInto(t, NewExtractor(), []*testTarEntry{{header: hdr}}, tmpdir)
+		var pathErr *InsecurePathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("%q: expected an InsecurePathError, got: %v", name, err)
+			continue
+		}
+		if pathErr.Name != name {
+			t.Errorf("unexpected name in error, wanted: %q, got: %q", name, pathErr.Name)
+		}
+		if err := checkExpectedFiles(tmpdir, nil); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestExtractorSymlinkTraversal(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, second := range []*tar.Header{
+		{Name: "evil/foo.txt", Typeflag: tar.TypeReg},
+		{Name: "evil/sub/", Typeflag: tar.TypeDir},
+		{Name: "evil/symlink", Typeflag: tar.TypeSymlink, Linkname: "foo"},
+		// hardlinking a file through the symlink would expose it
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "evil/passwd"},
+	} {
+		entries := []*testTarEntry{
+			{
+				// An absolute symlink, resolved outside of the
+				// target directory
+				header: &tar.Header{
+					Name:     "evil",
+					Typeflag: tar.TypeSymlink,
+					Linkname: outside,
+				},
+			},
+			{header: second},
+		}
+		name := second.Name
+		tmpdir, err := extractEntries(t, NewExtractor(), entries)
+		defer os.RemoveAll(tmpdir)
+		if err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+		expectedFiles := []*fileInfo{
+			{path: "evil", typeflag: tar.TypeSymlink},
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	outsideFiles := []*fileInfo{
+		{path: "passwd", typeflag: tar.TypeReg, size: 6},
+	}
+	if err := checkExpectedFiles(outside, fileInfoSliceToMap(outsideFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorHardlinkedSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "a",
+				Typeflag: tar.TypeSymlink,
+				Linkname: outside,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		// b is a second symlink to outside
+		{
+			header: &tar.Header{
+				Name:     "b",
+				Typeflag: tar.TypeLink,
+				Linkname: "a",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "b/x",
+				Typeflag: tar.TypeLink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	for name, extract := range map[string]func(dir string) error{
+		"Extractor": func(dir string) error {
+			return extractEntriesInto(t, NewExtractor(), entries, dir)
+		},
+		"ExtractTarInsecure": func(dir string) error {
+			return ExtractTarInsecure(tar.NewReader(bytes.NewReader(readTestTar(t, entries))), dir, true, nil, nil)
+		},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		err = extract(tmpdir)
+		var ile *InsecureLinkError
+		if !errors.As(err, &ile) {
+			t.Errorf("%s: expected an InsecureLinkError, got: %v", name, err)
+		} else if ile.Link != "b" {
+			t.Errorf("%s: unexpected symlink %q", name, ile.Link)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+			t.Errorf("%s: the extraction wrote through the hardlinked symlink: %v", name, err)
+		}
+	}
+}
+
+func TestExtractorReplacedSymlink(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "lib",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "/usr/lib",
+			},
+		},
+		// lib is now a real directory, writing in it is fine
+		{
+			header: &tar.Header{
+				Name:     "lib/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "lib/foo.so",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "lib", typeflag: tar.TypeDir},
+		{path: "lib/foo.so", typeflag: tar.TypeReg, size: 3},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorOptions(t *testing.T) {
+	mtime := time.Unix(100000, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name:    "folder/bar.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name:    "folder/baz.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+	}
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Mkdir(filepath.Join(tmpdir, "folder"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "folder/bar.txt"), []byte("previous"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pwl := PathWhitelistMap{
+		"folder":         struct{}{},
+		"folder/foo.txt": struct{}{},
+		"folder/bar.txt": struct{}{},
+		"folder/baz.txt": struct{}{},
+	}
+	var edited []string
+	editor := func(path string, _, _ int, _ byte, _ os.FileInfo) error {
+		edited = append(edited, path)
+		return nil
+	}
+	extracted := make(map[string]struct{})
+	progress := func(hdr *tar.Header, _ int64) {
+		extracted[hdr.Name] = struct{}{}
+	}
+	e := NewExtractor(
+		WithWhitelist(pwl),
+		WithFilter(func(hdr *tar.Header) bool { return hdr.Name != "folder/baz.txt" }),
+		WithOverwrite(OverwriteSkip),
+		WithPermissionsEditor(editor),
+		WithPreserveTimes(),
+		WithProgress(progress),
+	)
+	if err := extractEntriesInto(t, e, entries, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "folder/bar.txt", typeflag: tar.TypeReg, size: 8, contents: "previous"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := checkTime(filepath.Join(tmpdir, "folder/foo.txt"), mtime); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the skipped bar.txt isn't edited
+	if len(edited) != 2 {
+		t.Errorf("unexpected edited files: %v", edited)
+	}
+	if len(extracted) != 3 {
+		t.Errorf("unexpected extracted entries: %v", extracted)
+	}
+}
+
+func TestExtractorUmask(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0777),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0666),
+			},
+		},
+	}
+
+	prev := syscall.Umask(027)
+	defer syscall.Umask(prev)
+
+	for _, tt := range []struct {
+		opts     []Option
+		dirMode  os.FileMode
+		fileMode os.FileMode
+	}{
+		// the process umask is used by default
+		{nil, 0750, 0640},
+		{[]Option{WithUmask(077)}, 0700, 0600},
+		{[]Option{WithUmask(0)}, 0777, 0666},
+	} {
+		tmpdir, err := extractEntries(t, NewExtractor(tt.opts...), entries)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectedFiles := []*fileInfo{
+			{path: "folder", typeflag: tar.TypeDir, mode: tt.dirMode},
+			{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, mode: tt.fileMode},
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if umask := syscall.Umask(027); umask != 027 {
+			t.Errorf("process umask not restored, wanted: %#o, got: %#o", 027, umask)
+		}
+	}
+}
+
+func TestExtractorUmaskConcurrent(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+				Mode: int64(0666),
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	var wg sync.WaitGroup
+	for _, umask := range []int{0, 022, 077} {
+		wg.Add(1)
+		go func(umask int) {
+			defer wg.Done()
+			e := NewExtractor(WithUmask(umask))
+			want := os.FileMode(0666 &^ umask)
+			for i := 0; i < 20; i++ {
+				tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				defer os.RemoveAll(tmpdir)
+				if err := e.Extract(tar.NewReader(bytes.NewReader(data)), tmpdir); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				info, err := os.Stat(filepath.Join(tmpdir, "foo.txt"))
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if info.Mode().Perm() != want {
+					t.Errorf("umask %#o: unexpected mode, wanted: %#o, got: %#o", umask, want, info.Mode().Perm())
+				}
+			}
+		}(umask)
+	}
+	wg.Wait()
+}
+
+func TestStripComponents(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"a/b/c", 1, "b/c"},
+		{"a/b/c", 2, "c"},
+		{"a/b/c", 3, ""},
+		{"a/b/", 1, "b/"},
+		{"a/", 1, ""},
+		{"a", 1, ""},
+		{"/a/b", 1, "b"},
+		{"a//b", 1, "b"},
+		{"./a/b", 1, "a/b"},
+	}
+	for _, tt := range tests {
+		if got := stripComponents(tt.name, tt.n); got != tt.want {
+			t.Errorf("stripComponents(%q, %d): wanted: %q, got: %q", tt.name, tt.n, tt.want, got)
+		}
+	}
+}
+
+func TestExtractorFixedTimes(t *testing.T) {
+	fixed := time.Unix(1000000000, 0)
+	mtime := time.Unix(1500000000, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/subfolder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/subfolder/foo.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "subfolder/foo.txt",
+				ModTime:  mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/subfolder/foo.txt",
+				ModTime:  mtime,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithPreserveTimes(), WithFixedTimes(fixed)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range []string{"folder", "folder/subfolder", "folder/subfolder/foo.txt", "folder/symlink", "folder/hardlink"} {
+		info, err := os.Lstat(filepath.Join(tmpdir, p))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !info.ModTime().Equal(fixed) {
+			t.Errorf("%s: unexpected mtime, wanted: %v, got: %v", p, fixed, info.ModTime())
+		}
+	}
+}
+
+func TestExtractorSkipUnchanged(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name:    "folder/hello.txt",
+				Size:    5,
+				ModTime: mtime,
+			},
+		},
+	}
+	extract := func(dir string, opts ...Option) Stats {
+		var stats Stats
+		opts = append(opts, WithPreserveTimes(), WithSkipUnchanged(), WithStats(&stats))
+		if err := extractEntriesInto(t, NewExtractor(opts...), entries, dir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return stats
+	}
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if stats := extract(tmpdir); stats.Files != 2 || stats.Skipped != 0 {
+		t.Errorf("unexpected stats of the first extraction: %+v", stats)
+	}
+	if stats := extract(tmpdir); stats.Files != 0 || stats.Skipped != 2 || stats.Dirs != 1 {
+		t.Errorf("unexpected stats of the second extraction: %+v", stats)
+	}
+
+	// Only the size and modification time are compared
+	foo := filepath.Join(tmpdir, "folder/foo.txt")
+	if err := ioutil.WriteFile(foo, []byte("bar"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chtimes(foo, mtime, mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := extract(tmpdir); stats.Skipped != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// Unless the files are verified
+	expected := map[string]string{
+		"folder/foo.txt":   "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"folder/hello.txt": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if stats := extract(tmpdir, WithVerify(expected, sha256.New)); stats.Files != 1 || stats.Skipped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if data, err := ioutil.ReadFile(foo); err != nil || string(data) != "foo" {
+		t.Errorf("expected the changed file to be rewritten, got: %q, %v", data, err)
+	}
+
+	// A modification time differing from the header's
+	if err := os.Chtimes(foo, mtime, mtime.Add(time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := extract(tmpdir); stats.Files != 1 || stats.Skipped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestExtractorSkipFileData(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0750,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: 0640,
+			},
+		},
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "folder/run.sh",
+				Size: 9,
+				Mode: 0755,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir, mode: 0750},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, mode: 0640},
+		{path: "folder/run.sh", typeflag: tar.TypeReg, mode: 0755},
+		{path: "folder/symlink", typeflag: tar.TypeSymlink},
+		{path: "folder/hardlink", typeflag: tar.TypeReg, mode: 0640},
+	}
+	for _, concurrency := range []int{0, 4} {
+		var stats Stats
+		var manifest []ExtractedEntry
+		e := NewExtractor(WithSkipFileData(), WithUmask(022), WithConcurrency(concurrency),
+			WithStats(&stats), WithManifest(&manifest), WithDigest(sha256.New))
+		tmpdir, err := extractEntries(t, e, entries)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("concurrency %d: unexpected error: %v", concurrency, err)
+		}
+		if stats.Files != 2 || stats.BytesWritten != 0 {
+			t.Errorf("concurrency %d: unexpected stats: %+v", concurrency, stats)
+		}
+		// The digests are the ones of the contents in the archive
+		if manifest[1].Digest != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+			t.Errorf("concurrency %d: unexpected digest %q", concurrency, manifest[1].Digest)
+		}
+	}
+}
+
+func TestExtractorSkipEmptyOverExisting(t *testing.T) {
+	base := []*testTarEntry{
+		{
+			contents: "populated",
+			header: &tar.Header{
+				Name: "etc/app.conf",
+				Size: 9,
+			},
+		},
+		{
+			contents: "",
+			header: &tar.Header{
+				Name: "etc/empty",
+			},
+		},
+	}
+	layer := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name: "etc/app.conf",
+			},
+		},
+		{
+			contents: "filled",
+			header: &tar.Header{
+				Name: "etc/empty",
+				Size: 6,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "etc/new",
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(), base)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := extractEntriesInto(t, NewExtractor(WithSkipEmptyOverExisting()), layer, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/app.conf", typeflag: tar.TypeReg, size: 9, contents: "populated"},
+		{path: "etc/empty", typeflag: tar.TypeReg, size: 6, contents: "filled"},
+		{path: "etc/new", typeflag: tar.TypeReg},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Without the option, the file is truncated
+	if err := extractEntriesInto(t, NewExtractor(), layer, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles[1] = &fileInfo{path: "etc/app.conf", typeflag: tar.TypeReg}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorStripComponents(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "readme",
+			header: &tar.Header{
+				Name: "README",
+				Size: 6,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "project-1.2.3/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "project-1.2.3/bin/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "project-1.2.3/bin/foo",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "project-1.2.3/bin/bar",
+				Typeflag: tar.TypeLink,
+				Linkname: "project-1.2.3/bin/foo",
+			},
+		},
+		// Symlink targets are left untouched
+		{
+			header: &tar.Header{
+				Name:     "project-1.2.3/current",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "project-1.2.3/bin",
+			},
+		},
+		// The hardlink target doesn't have enough elements
+		{
+			header: &tar.Header{
+				Name:     "project-1.2.3/readme",
+				Typeflag: tar.TypeLink,
+				Linkname: "README",
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithStripComponents(1)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "bin", typeflag: tar.TypeDir},
+		{path: "bin/foo", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "bin/bar", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "current", typeflag: tar.TypeSymlink},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	link, err := os.Readlink(filepath.Join(tmpdir, "current"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link != "project-1.2.3/bin" {
+		t.Errorf("unexpected symlink target, wanted: %q, got: %q", "project-1.2.3/bin", link)
+	}
+	foo, err := os.Stat(filepath.Join(tmpdir, "bin/foo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bar, err := os.Stat(filepath.Join(tmpdir, "bin/bar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !os.SameFile(foo, bar) {
+		t.Errorf("expected bin/bar to be a hardlink to bin/foo")
+	}
+}
+
+func TestExtractorRename(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "manifest",
+			header: &tar.Header{
+				Name: "manifest",
+				Size: 8,
+			},
+		},
+		{
+			contents: "busybox",
+			header: &tar.Header{
+				Name: "rootfs/bin/busybox",
+				Size: 7,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "rootfs/bin/sh",
+				Typeflag: tar.TypeLink,
+				Linkname: "rootfs/bin/busybox",
+			},
+		},
+		{
+			contents: "conf",
+			header: &tar.Header{
+				Name: "rootfs/old/app.conf",
+				Size: 4,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "rootfs/etc/app.conf",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "/rootfs/old/app.conf",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "rootfs/etc/relative",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../bin/sh",
+			},
+		},
+	}
+	rename := func(name string) (string, bool) {
+		if !strings.HasPrefix(name, "rootfs/") {
+			return "", false
+		}
+		name = strings.TrimPrefix(name, "rootfs/")
+		if strings.HasPrefix(name, "old/") {
+			name = "new/" + strings.TrimPrefix(name, "old/")
+		}
+		return name, true
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithRename(rename)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "bin", typeflag: tar.TypeDir},
+		{path: "bin/busybox", typeflag: tar.TypeReg, size: 7, contents: "busybox"},
+		{path: "bin/sh", typeflag: tar.TypeReg, size: 7, contents: "busybox"},
+		{path: "new", typeflag: tar.TypeDir},
+		{path: "new/app.conf", typeflag: tar.TypeReg, size: 4, contents: "conf"},
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/app.conf", typeflag: tar.TypeSymlink},
+		{path: "etc/relative", typeflag: tar.TypeSymlink},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	busybox, err := os.Stat(filepath.Join(tmpdir, "bin/busybox"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sh, err := os.Stat(filepath.Join(tmpdir, "bin/sh"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !os.SameFile(busybox, sh) {
+		t.Errorf("expected bin/sh to be a hardlink to bin/busybox")
+	}
+	for name, want := range map[string]string{"etc/app.conf": "/new/app.conf", "etc/relative": "../bin/sh"} {
+		link, err := os.Readlink(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if link != want {
+			t.Errorf("unexpected target of %s, wanted: %q, got: %q", name, want, link)
+		}
+	}
+}
+
+func TestExtractorMaxEntries(t *testing.T) {
+	var entries []*testTarEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &testTarEntry{
+			header: &tar.Header{
+				Name: fmt.Sprintf("file%d", i),
+			},
+		})
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(WithMaxEntries(10)), entries)
+	os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tmpdir, err = extractEntries(t, NewExtractor(WithMaxEntries(9)), entries)
+	defer os.RemoveAll(tmpdir)
+	if !errors.Is(err, ErrMaxEntriesExceeded) {
+		t.Fatalf("expected ErrMaxEntriesExceeded, got: %v", err)
+	}
+	// Nothing after the limit is extracted
+	if _, err := os.Lstat(filepath.Join(tmpdir, "file9")); !os.IsNotExist(err) {
+		t.Errorf("expected file9 not to be extracted, got: %v", err)
+	}
+}
+
+func TestExtractorDetectDuplicates(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "./foo",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "foo/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "foo/baz.txt",
+				Size: 3,
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(WithDetectDuplicates(DuplicateFail)), entries)
+	defer os.RemoveAll(tmpdir)
+	var dee *DuplicateEntryError
+	if !errors.As(err, &dee) {
+		t.Fatalf("expected a DuplicateEntryError, got: %v", err)
+	}
+	if dee.Name != "foo" || dee.Type != tar.TypeDir || dee.Existing != tar.TypeReg {
+		t.Errorf("unexpected error: %+v", dee)
+	}
+	// The replacement of the same type is extracted
+	expectedFiles := []*fileInfo{
+		{path: "foo", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var lines []string
+	logger := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	e := NewExtractor(WithDetectDuplicates(DuplicateLastWins), WithLogger(logger, LogNotices))
+	tmpdir, err = extractEntries(t, e, entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles = []*fileInfo{
+		{path: "foo", typeflag: tar.TypeDir},
+		{path: "foo/baz.txt", typeflag: tar.TypeReg, size: 3, contents: "baz"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], `"foo" of type '5'`) {
+		t.Errorf("unexpected log: %q", lines)
+	}
+}
+
+func TestExtractorMaxDepth(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name: "./a/b/c/file",
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(WithMaxDepth(4)), entries)
+	os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deep := strings.Repeat("a/", 1000) + "file"
+	entries = append(entries, &testTarEntry{
+		header: &tar.Header{
+			Name: deep,
+		},
+	})
+	tmpdir, err = extractEntries(t, NewExtractor(WithMaxDepth(4)), entries)
+	defer os.RemoveAll(tmpdir)
+	if !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Fatalf("expected ErrMaxDepthExceeded, got: %v", err)
+	}
+
+	// The limit is checked before touching the filesystem
+	fs := newFakeFS()
+	e := NewExtractor(WithFS(fs), WithMaxDepth(4))
+	err = e.Extract(tar.NewReader(bytes.NewReader(readTestTar(t, entries[1:]))), "/fake")
+	if !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Fatalf("expected ErrMaxDepthExceeded, got: %v", err)
+	}
+	if len(fs.ops) != 0 {
+		t.Errorf("unexpected operations: %q", fs.ops)
+	}
+}
+
+// largeTar is an io.ReaderAt of a tarball made of the given header, with a
+// body of zeros of the size of the header, followed by the given entries.
+type largeTar struct {
+	hdr  []byte
+	size int64
+	tail []byte
+}
+
+func newLargeTar(t *testing.T, hdr *tar.Header, entries []*testTarEntry) *largeTar {
+	var buf bytes.Buffer
+	// The header blocks are written before the body
+	if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	size := (hdr.Size + 511) / 512 * 512
+	return &largeTar{hdr: buf.Bytes(), size: size, tail: readTestTar(t, entries)}
+}
+
+func (l *largeTar) Size() int64 {
+	return int64(len(l.hdr)) + l.size + int64(len(l.tail))
+}
+
+func (l *largeTar) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		var m int
+		switch {
+		case pos < int64(len(l.hdr)):
+			m = copy(p[n:], l.hdr[pos:])
+		case pos < int64(len(l.hdr))+l.size:
+			end := int64(len(l.hdr)) + l.size - pos
+			if end > int64(len(p)-n) {
+				end = int64(len(p) - n)
+			}
+			for i := range p[n : n+int(end)] {
+				p[n+i] = 0
+			}
+			m = int(end)
+		case pos < l.Size():
+			m = copy(p[n:], l.tail[pos-int64(len(l.hdr))-l.size:])
+		default:
+			return n, io.EOF
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func TestExtractorPAXSizeAndTimes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping the test, it reads more than 8GiB of zeros")
+	}
+	// More than the 8GiB - 1 a ustar header can hold
+	const size = 8<<30 + 1
+	mtime := time.Unix(1e9, 123456789)
+	atime := time.Unix(1e9, 987654321)
+	hdr := &tar.Header{
+		Name:       "large",
+		Size:       size,
+		Mode:       0644,
+		ModTime:    mtime,
+		AccessTime: atime,
+		Format:     tar.FormatPAX,
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	lt := newLargeTar(t, hdr, entries)
+
+	var seen *tar.Header
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		if hdr.Name == "large" {
+			seen = hdr
+		}
+		return hdr, nil
+	}
+	// Nothing is written by a dry run, the file is still read completely
+	var manifest []ExtractedEntry
+	e := NewExtractor(WithDryRun(), WithHeaderTransform(transform), WithManifest(&manifest))
+	if err := e.Extract(tar.NewReader(io.NewSectionReader(lt, 0, lt.Size())), "/nonexistent"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seen == nil {
+		t.Fatalf("the transform wasn't called with the large file")
+	}
+	if seen.Size != size || !seen.ModTime.Equal(mtime) || !seen.AccessTime.Equal(atime) {
+		t.Errorf("unexpected header, wanted size %d, mtime %v and atime %v, got: %+v", int64(size), mtime, atime, seen)
+	}
+	if len(manifest) != 2 || manifest[0].Size != size || manifest[1].Name != "foo.txt" {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+}
+
+func TestExtractorEntryTimeout(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// The reader stalls in the middle of the contents of slow.txt
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		tw := tar.NewWriter(pw)
+		tw.WriteHeader(&tar.Header{Name: "fast.txt", Size: 4, Mode: 0644})
+		tw.Write([]byte("fast"))
+		tw.WriteHeader(&tar.Header{Name: "slow.txt", Size: 4, Mode: 0644})
+		tw.Write([]byte("sl"))
+		tw.Flush()
+	}()
+	e := NewExtractor(WithEntryTimeout(50 * time.Millisecond))
+	err = e.Extract(tar.NewReader(pr), tmpdir)
+	var te *TimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected a TimeoutError, got: %v", err)
+	}
+	if te.Name != "slow.txt" || te.Timeout != 50*time.Millisecond {
+		t.Errorf("unexpected error: %+v", te)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "fast.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// slowWriteFS is a fakeFS whose files take delay for every write.
+type slowWriteFS struct {
+	*fakeFS
+	delay time.Duration
+}
+
+type slowFile struct {
+	File
+	delay time.Duration
+}
+
+func (fs *slowWriteFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.fakeFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return slowFile{File: f, delay: fs.delay}, nil
+}
+
+func (f slowFile) Write(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.Write(p)
+}
+
+func TestExtractorEntryTimeoutSlowWrites(t *testing.T) {
+	// Writing big.txt takes longer than the timeout, reading it doesn't
+	contents := strings.Repeat("x", 4*32*1024)
+	entries := []*testTarEntry{
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "big.txt",
+				Size: int64(len(contents)),
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	for _, opts := range [][]Option{nil, {WithConcurrency(2)}} {
+		fs := &slowWriteFS{fakeFS: newFakeFS(), delay: 50 * time.Millisecond}
+		e := NewExtractor(append([]Option{WithFS(fs), WithEntryTimeout(100 * time.Millisecond)}, opts...)...)
+		if err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if f := fs.files["/fake/big.txt"]; f == nil || len(f.data) != len(contents) {
+			t.Errorf("big.txt not extracted")
+		}
+	}
+}
+
+func TestExtractorGlobalHeader(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{"mtime": "1500000000.5", "comment": "test"},
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "inherited.txt",
+				Size:    3,
+				ModTime: time.Unix(1000000000, 0),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "overridden.txt",
+				Size: 3,
+				// Recorded in a PAX record
+				ModTime: time.Unix(1600000000, 25),
+				Format:  tar.FormatPAX,
+			},
+		},
+		{
+			header: &tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{"mtime": ""},
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name:    "reset.txt",
+				Size:    3,
+				ModTime: time.Unix(1000000000, 0),
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithPreserveTimes()), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "inherited.txt", typeflag: tar.TypeReg, size: 3},
+		{path: "overridden.txt", typeflag: tar.TypeReg, size: 3},
+		{path: "reset.txt", typeflag: tar.TypeReg, size: 3},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		path  string
+		mtime time.Time
+	}{
+		{"inherited.txt", time.Unix(1500000000, 500000000)},
+		{"overridden.txt", time.Unix(1600000000, 25)},
+		{"reset.txt", time.Unix(1000000000, 0)},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(tmpdir, tt.path))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !info.ModTime().Equal(tt.mtime) {
+			t.Errorf("%s: unexpected mtime, wanted: %v, got: %v", tt.path, tt.mtime, info.ModTime())
+		}
+	}
+}
+
+func TestParsePAXTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+		fail bool
+	}{
+		{in: "1500000000", want: time.Unix(1500000000, 0)},
+		{in: "1500000000.5", want: time.Unix(1500000000, 500000000)},
+		{in: "1500000000.1234567891", want: time.Unix(1500000000, 123456789)},
+		{in: "-1.5", want: time.Unix(-1, -500000000)},
+		{in: "1.+5", fail: true},
+		{in: "foo", fail: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePAXTime(tt.in)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%q: wanted %v, got: %v, %v", tt.in, tt.want, got, err)
+		}
+	}
+}
+
+func TestExtractorConcatenated(t *testing.T) {
+	first := readTestTar(t, []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	})
+	second := readTestTar(t, []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "folder/hello.txt",
+				Size: 5,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	})
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "folder/hello.txt", typeflag: tar.TypeReg, size: 5, contents: "hello"},
+		{path: "bar.txt", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"concatenated", append(append([]byte{}, first...), second...)},
+		// Zero blocks between the tarballs and after the last one
+		{"padded", bytes.Join([][]byte{first, make([]byte, 10*blockSize), second, make([]byte, 3*blockSize)}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(tmpdir)
+			e := NewExtractor()
+			if err := e.ExtractConcatenated(context.Background(), bytes.NewReader(tt.data), tmpdir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// A truncated second tarball isn't mistaken for padding
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	data := append(append([]byte{}, first...), second[:blockSize+2]...)
+	if err := NewExtractor().ExtractConcatenated(context.Background(), bytes.NewReader(data), tmpdir); err == nil {
+		t.Errorf("expected an error for the truncated tarball")
+	}
+}
+
+func TestExtractorConcatenatedSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	first := readTestTar(t, []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "a",
+				Typeflag: tar.TypeSymlink,
+				Linkname: outside,
+			},
+		},
+	})
+	second := readTestTar(t, []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "a/x",
+				Size: 3,
+			},
+		},
+	})
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	data := append(append([]byte{}, first...), second...)
+	err = NewExtractor().ExtractConcatenated(context.Background(), bytes.NewReader(data), tmpdir)
+	var ile *InsecureLinkError
+	if !errors.As(err, &ile) {
+		t.Errorf("expected an InsecureLinkError, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("the second tarball wrote through the symlink of the first one: %v", err)
+	}
+}
+
+func TestExtractorConcatenatedDirs(t *testing.T) {
+	mtime := time.Unix(1000000000, 0)
+	first := readTestTar(t, []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				ModTime:  mtime,
+			},
+		},
+	})
+	second := readTestTar(t, []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	})
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// The times of the directories are restored once the last tarball
+	// is extracted
+	data := append(append([]byte{}, first...), second...)
+	e := NewExtractor(WithPreserveTimes())
+	if err := e.ExtractConcatenated(context.Background(), bytes.NewReader(data), tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(tmpdir, "folder"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v", mtime, info.ModTime())
+	}
+}
+
+func TestExtractorMaxTotalBytes(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: strings.Repeat("a", 100000),
+			header: &tar.Header{
+				Name: "huge.txt",
+				Size: 100000,
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(WithMaxTotalBytes(100003)), entries)
+	os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tmpdir, err = extractEntries(t, NewExtractor(WithMaxTotalBytes(50000)), entries)
+	defer os.RemoveAll(tmpdir)
+	if !errors.Is(err, ErrMaxBytesExceeded) {
+		t.Fatalf("expected ErrMaxBytesExceeded, got: %v", err)
+	}
+	// The copy is stopped in the middle of the file
+	info, err := os.Stat(filepath.Join(tmpdir, "huge.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Size() > 50000 {
+		t.Errorf("expected at most 50000 bytes to be written, got: %d", info.Size())
+	}
+}
+
+func TestExtractorXattrs(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	// Set the xattrs in the Xattrs field only, like a header built by
+	// hand would
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.PAXRecords = nil
+		hdr.Xattrs = map[string]string{"user.rkt": "value"}
+		return hdr, nil
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithXattrs(true), WithHeaderTransform(transform)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		if strings.Contains(err.Error(), syscall.ENOTSUP.Error()) {
+			t.Skipf("xattrs not supported on %s. Disabling test.", tmpdir)
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, err := fileutil.Lgetxattr(filepath.Join(tmpdir, "foo.txt"), "user.rkt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(value) != "value" {
+		t.Errorf("unexpected xattr value, wanted: %q, got: %q", "value", value)
+	}
+}
+
+// pingCapability is a security.capability value giving CAP_NET_RAW.
+const pingCapability = "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func TestExtractorFileCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("setting file capabilities requires root. Disabling test.")
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "ping",
+				Size: 3,
+				Mode: 0755,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + capabilityXattr: pingCapability,
+				},
+			},
+		},
+	}
+	// Changing the owner of a file drops its capabilities, they must be
+	// set after it
+	tmpdir, err := extractEntries(t, NewExtractor(WithChown(true), WithXattrs(true)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		if strings.Contains(err.Error(), syscall.ENOTSUP.Error()) {
+			t.Skipf("xattrs not supported on %s. Disabling test.", tmpdir)
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, err := fileutil.Lgetxattr(filepath.Join(tmpdir, "ping"), capabilityXattr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(value) != pingCapability {
+		t.Errorf("unexpected capabilities, wanted: %q, got: %q", pingCapability, value)
+	}
+}
+
+func TestExtractorFileCapabilitiesUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skipf("root can set file capabilities. Disabling test.")
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "ping",
+				Size: 3,
+				Mode: 0755,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + capabilityXattr: pingCapability,
+				},
+			},
+		},
+	}
+	var lines []string
+	logger := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithXattrs(true), WithLogger(logger, LogNotices)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		if strings.Contains(err.Error(), syscall.ENOTSUP.Error()) {
+			t.Skipf("xattrs not supported on %s. Disabling test.", tmpdir)
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], "file capabilities") {
+		t.Errorf("unexpected log: %q", lines)
+	}
+}
+
+// posixACL encodes the ACL entries, given as tag, permissions and id
+// triplets, like the system.posix_acl_* extended attributes.
+func posixACL(entries ...[3]uint32) string {
+	buf := []byte{2, 0, 0, 0}
+	for _, entry := range entries {
+		buf = append(buf, byte(entry[0]), byte(entry[0]>>8), byte(entry[1]), byte(entry[1]>>8))
+		buf = append(buf, byte(entry[2]), byte(entry[2]>>8), byte(entry[2]>>16), byte(entry[2]>>24))
+	}
+	return string(buf)
+}
+
+func TestExtractorACLs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("setting the ACLs of files owned by others requires root. Disabling test.")
+	}
+	const undefinedID = 0xffffffff
+	fileACL := posixACL(
+		[3]uint32{0x01, 06, undefinedID}, // user::rw-
+		[3]uint32{0x02, 06, 1000},        // user:1000:rw-
+		[3]uint32{0x04, 04, undefinedID}, // group::r--
+		[3]uint32{0x10, 06, undefinedID}, // mask::rw-
+		[3]uint32{0x20, 04, undefinedID}, // other::r--
+	)
+	dirACL := posixACL(
+		[3]uint32{0x01, 07, undefinedID}, // user::rwx
+		[3]uint32{0x02, 07, 1000},        // user:1000:rwx
+		[3]uint32{0x04, 05, undefinedID}, // group::r-x
+		[3]uint32{0x10, 07, undefinedID}, // mask::rwx
+		[3]uint32{0x20, 05, undefinedID}, // other::r-x
+	)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "shared/",
+				Typeflag: tar.TypeDir,
+				// The group class bits differ from the mask,
+				// which is restored after the mode
+				Mode: 0755,
+				Uid:  1000,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + aclAccessXattr:  dirACL,
+					paxSchilyXattr + aclDefaultXattr: dirACL,
+				},
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "shared/foo.txt",
+				Size: 3,
+				Mode: 0664,
+				Uid:  1000,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + aclAccessXattr: fileACL,
+				},
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "shared/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				PAXRecords: map[string]string{
+					paxSchilyXattr + aclAccessXattr: fileACL,
+				},
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithChown(true), WithACLs(true)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		if strings.Contains(err.Error(), syscall.ENOTSUP.Error()) {
+			t.Skipf("ACLs not supported on %s. Disabling test.", tmpdir)
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		attr  string
+		value string
+		mode  os.FileMode
+	}{
+		{"shared", aclAccessXattr, dirACL, os.ModeDir | 0775},
+		{"shared", aclDefaultXattr, dirACL, os.ModeDir | 0775},
+		{"shared/foo.txt", aclAccessXattr, fileACL, 0664},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(tmpdir, tt.path)
+		value, err := fileutil.Lgetxattr(p, tt.attr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(value) != tt.value {
+			t.Errorf("%s: unexpected %s, wanted: %q, got: %q", tt.path, tt.attr, tt.value, value)
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Mode() != tt.mode {
+			t.Errorf("%s: unexpected mode, wanted: %v, got: %v", tt.path, tt.mode, info.Mode())
+		}
+	}
+}
+
+func TestExtractorACLsStrict(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + aclAccessXattr: posixACL([3]uint32{0x01, 06, 0xffffffff}),
+					paxSchilyXattr + "user.comment": "foo",
+				},
+			},
+		},
+	}
+	tests := []struct {
+		opts []Option
+		fail bool
+	}{
+		{[]Option{WithACLs(true)}, true},
+		{[]Option{WithACLs(false)}, false},
+		{[]Option{WithXattrs(true)}, true},
+		{[]Option{WithXattrs(true), WithACLs(false)}, true},
+		{[]Option{WithXattrs(false), WithACLs(true)}, true},
+		{[]Option{WithXattrs(false), WithACLs(false)}, false},
+	}
+	for i, tt := range tests {
+		// The fake FS doesn't support extended attributes
+		fs := newFakeFS()
+		data := readTestTar(t, entries)
+		opts := append([]Option{WithFS(fs)}, tt.opts...)
+		err := NewExtractor(opts...).Extract(tar.NewReader(bytes.NewReader(data)), "/fake")
+		if tt.fail && err == nil {
+			t.Errorf("#%d: expected an error", i)
+		}
+		if !tt.fail && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestExtractorUnsupportedType(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "contiguous",
+				Typeflag: tar.TypeCont,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(), entries)
+	os.RemoveAll(tmpdir)
+	var ute *UnsupportedTypeError
+	if !errors.As(err, &ute) {
+		t.Fatalf("expected an UnsupportedTypeError, got: %v", err)
+	}
+	if ute.Name != "contiguous" || ute.Type != tar.TypeCont {
+		t.Errorf("unexpected error fields, wanted: %q %q, got: %q %q", "contiguous", tar.TypeCont, ute.Name, ute.Type)
+	}
+
+	var warnings []error
+	warn := func(err error) {
+		warnings = append(warnings, err)
+	}
+	tmpdir, err = extractEntries(t, NewExtractor(WithSkipUnsupported(warn)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(warnings) != 1 || !errors.As(warnings[0], &ute) || ute.Name != "contiguous" {
+		t.Errorf("expected a warning for the unsupported entry, got: %v", warnings)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorInsecureLinkError(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/passwd", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+		{Name: "shadow", Typeflag: tar.TypeLink, Linkname: "../etc/shadow"},
+	} {
+		name := hdr.Name
+		err := extractEntriesInto(t, NewExtractor(), []*testTarEntry{{header: hdr}}, tmpdir)
+		var linkErr *InsecureLinkError
+		if !errors.As(err, &linkErr) {
+			t.Errorf("%q: expected an InsecureLinkError, got: %v", name, err)
+			continue
+		}
+		if linkErr.Path != filepath.Join(tmpdir, name) || linkErr.Link != hdr.Linkname || linkErr.Type != hdr.Typeflag {
+			t.Errorf("%q: unexpected error fields: %+v", name, linkErr)
+		}
+		if err := checkExpectedFiles(tmpdir, nil); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestExtractorLongLinknames(t *testing.T) {
+	// Over the 100 bytes of the USTAR linkname field
+	long := strings.Repeat("long/", 40) + "foo.txt"
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		entries := []*testTarEntry{
+			{
+				contents: "foo",
+				header: &tar.Header{
+					Name:   long,
+					Size:   3,
+					Format: format,
+				},
+			},
+			{
+				header: &tar.Header{
+					Name:     "symlink",
+					Typeflag: tar.TypeSymlink,
+					Linkname: long,
+					Format:   format,
+				},
+			},
+			{
+				header: &tar.Header{
+					Name:     "hardlink",
+					Typeflag: tar.TypeLink,
+					Linkname: long,
+					Format:   format,
+				},
+			},
+		}
+		tmpdir, err := extractEntries(t, NewExtractor(), entries)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", format, err)
+		}
+		target, err := os.Readlink(filepath.Join(tmpdir, "symlink"))
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", format, err)
+		}
+		if target != long {
+			t.Errorf("%v: unexpected symlink target %q", format, target)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(tmpdir, "hardlink"))
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", format, err)
+		}
+		if string(data) != "foo" {
+			t.Errorf("%v: unexpected hardlink contents %q", format, data)
+		}
+	}
+}
+
+func TestExtractorSafeParents(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("root"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	newTarget := func() string {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// Not created by the archive
+		if err := os.MkdirAll(filepath.Join(tmpdir, "real/dir"), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.Symlink(outside, filepath.Join(tmpdir, "real/etc")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return tmpdir
+	}
+
+	tests := []struct {
+		entry *testTarEntry
+		link  string
+	}{
+		{
+			entry: &testTarEntry{
+				contents: "foo",
+				header: &tar.Header{
+					Name: "real/etc/foo.txt",
+					Size: 3,
+				},
+			},
+			link: "real/etc",
+		},
+		{
+			entry: &testTarEntry{
+				header: &tar.Header{
+					Name:     "real/etc/sub/",
+					Typeflag: tar.TypeDir,
+				},
+			},
+			link: "real/etc",
+		},
+		{
+			entry: &testTarEntry{
+				header: &tar.Header{
+					Name:     "passwd",
+					Typeflag: tar.TypeLink,
+					Linkname: "real/etc/passwd",
+				},
+			},
+			link: "real/etc",
+		},
+		// The whiteouts would remove the files outside
+		{
+			entry: &testTarEntry{
+				header: &tar.Header{
+					Name: "real/etc/.wh.passwd",
+				},
+			},
+			link: "real/etc",
+		},
+		{
+			entry: &testTarEntry{
+				header: &tar.Header{
+					Name: "real/etc/" + whiteoutOpaque,
+				},
+			},
+			link: "real/etc",
+		},
+	}
+	for _, tt := range tests {
+		tmpdir := newTarget()
+		defer os.RemoveAll(tmpdir)
+		err := extractEntriesInto(t, NewExtractor(WithSafeParents(), WithWhiteouts()), []*testTarEntry{tt.entry}, tmpdir)
+		var ile *InsecureLinkError
+		if !errors.As(err, &ile) {
+			t.Errorf("%s: expected an InsecureLinkError, got: %v", tt.entry.header.Name, err)
+		} else if ile.Link != tt.link {
+			t.Errorf("%s: unexpected symlink %q", tt.entry.header.Name, ile.Link)
+		}
+	}
+	files, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected nothing to be written through the symlink, got: %d files", len(files))
+	}
+
+	// The directories and the symlinks themselves can be replaced
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "real/dir/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "real/etc",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "real/etc/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTarget()
+	defer os.RemoveAll(tmpdir)
+	if err := extractEntriesInto(t, NewExtractor(WithSafeParents()), entries, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "real", typeflag: tar.TypeDir},
+		{path: "real/dir", typeflag: tar.TypeDir},
+		{path: "real/dir/foo.txt", typeflag: tar.TypeReg, size: 3},
+		{path: "real/etc", typeflag: tar.TypeDir},
+		{path: "real/etc/bar.txt", typeflag: tar.TypeReg, size: 3},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// By default the symlink is followed
+	tmpdir = newTarget()
+	defer os.RemoveAll(tmpdir)
+	if err := extractEntriesInto(t, NewExtractor(), []*testTarEntry{tests[0].entry}, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorSymlinkTargets(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		linkname string
+		ok       bool
+	}{
+		{"a/b/link", "../sibling", true},
+		{"a/b/link", "../../sibling", true},
+		{"a/b/link", "./../b/../../a/./sibling", true},
+		{"a/b/link", "../../../sibling", false},
+		{"a/b/link", "../../a/../../sibling", false},
+		{"a/b/link", "/a/sibling", true},
+		{"a/b/link", "/../sibling", false},
+		{"a/b/link", "/a/b/../../../sibling", false},
+	} {
+		hdr := &tar.Header{Name: tt.name, Typeflag: tar.TypeSymlink, Linkname: tt.linkname}
+		tmpdir, err := extractEntries(t, NewExtractor(), []*testTarEntry{{header: hdr}})
+		os.RemoveAll(tmpdir)
+		var linkErr *InsecureLinkError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%q: unexpected error: %v", tt.linkname, err)
+		case !tt.ok && !errors.As(err, &linkErr):
+			t.Errorf("%q: expected an InsecureLinkError, got: %v", tt.linkname, err)
+		}
+	}
+}
+
+// devFS is a fakeFS whose files are on the device of the longest mount point
+// prefixing their path, or on device 1.
+type devFS struct {
+	*fakeFS
+	mounts map[string]uint64
+}
+
+// devInfo is the FileInfo of a devFS file.
+type devInfo struct {
+	os.FileInfo
+	dev uint64
+}
+
+func (i devInfo) Sys() interface{} { return &syscall.Stat_t{Dev: i.dev} }
+
+func (fs *devFS) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.fakeFS.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	dev, longest := uint64(1), ""
+	for mount, d := range fs.mounts {
+		if (name == mount || strings.HasPrefix(name, mount+"/")) && len(mount) > len(longest) {
+			dev, longest = d, mount
+		}
+	}
+	return devInfo{FileInfo: info, dev: dev}, nil
+}
+
+func TestExtractorStayOnDevice(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "mnt/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "mnt/new/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "baz.txt",
+				Size: 3,
+			},
+		},
+	}
+	newFS := func() *devFS {
+		fs := &devFS{fakeFS: newFakeFS(), mounts: map[string]uint64{"/fake/mnt": 2}}
+		fs.files["/fake"] = &fakeFile{name: "/fake", mode: os.ModeDir | 0755}
+		fs.files["/fake/mnt"] = &fakeFile{name: "/fake/mnt", mode: os.ModeDir | 0755}
+		return fs
+	}
+	data := readTestTar(t, entries)
+
+	fs := newFS()
+	err := NewExtractor(WithFS(fs), WithStayOnDevice(true)).Extract(tar.NewReader(bytes.NewReader(data)), "/fake")
+	var cde *CrossDeviceError
+	if !errors.As(err, &cde) {
+		t.Fatalf("expected a CrossDeviceError, got: %v", err)
+	}
+	if cde.Name != "mnt/" || cde.Path != "/fake/mnt" {
+		t.Errorf("unexpected error: %+v", cde)
+	}
+
+	fs = newFS()
+	var manifest []ExtractedEntry
+	e := NewExtractor(WithFS(fs), WithStayOnDevice(false), WithManifest(&manifest))
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var skipped []string
+	for _, entry := range manifest {
+		if entry.Skipped {
+			skipped = append(skipped, entry.Name)
+		}
+	}
+	if !reflect.DeepEqual(skipped, []string{"mnt/", "mnt/new/bar.txt"}) {
+		t.Errorf("unexpected skipped entries: %v", skipped)
+	}
+	for _, p := range []string{"/fake/foo.txt", "/fake/baz.txt"} {
+		if _, ok := fs.files[p]; !ok {
+			t.Errorf("%s not extracted", p)
+		}
+	}
+	if _, ok := fs.files["/fake/mnt/new"]; ok {
+		t.Errorf("the extraction wrote on the mounted filesystem")
+	}
+}
+
+func TestExtractorStayOnDeviceMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("mounting requires root. Disabling test.")
+	}
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	mnt := filepath.Join(tmpdir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("could not mount a tmpfs: %v. Disabling test.", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "mnt/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	err = extractEntriesInto(t, NewExtractor(WithStayOnDevice(true)), entries, tmpdir)
+	var cde *CrossDeviceError
+	if !errors.As(err, &cde) {
+		t.Fatalf("expected a CrossDeviceError, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, "foo.txt")); !os.IsNotExist(err) {
+		t.Errorf("the extraction wrote on the mounted filesystem: %v", err)
+	}
+}
+
+func TestExtractorChroot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("chroot requires root. Disabling test.")
+	}
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	dir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// A symlink already in the target directory isn't checked by the
+	// extraction, the chroot makes it point inside
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, outside), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "evil",
+			header: &tar.Header{
+				Name: "link/evil",
+				Size: 4,
+			},
+		},
+	}
+	if err := extractEntriesInto(t, NewExtractor(WithChroot()), entries, dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Errorf("the extraction escaped the chroot: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, outside, "evil"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "evil" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+
+	// The root directory of the process is untouched
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	src := filepath.Join(tmpdir, "src")
+	if err := ioutil.WriteFile(src, []byte("foo"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chmod(src, 0751); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mtime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Simulate the fallback of a hardlink to another filesystem
+	dst := filepath.Join(tmpdir, "dst")
+	if err := copyFile(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	contents, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(contents) != "foo" {
+		t.Errorf("unexpected contents, wanted: %q, got: %q", "foo", contents)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if os.SameFile(srcInfo, dstInfo) {
+		t.Errorf("expected a copy, got a hardlink")
+	}
+	if dstInfo.Mode() != 0751 {
+		t.Errorf("unexpected mode, wanted: %v, got: %v", os.FileMode(0751), dstInfo.Mode())
+	}
+	if !dstInfo.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime, wanted: %v, got: %v", mtime, dstInfo.ModTime())
+	}
+	srcSt := srcInfo.Sys().(*syscall.Stat_t)
+	dstSt := dstInfo.Sys().(*syscall.Stat_t)
+	if srcSt.Uid != dstSt.Uid || srcSt.Gid != dstSt.Gid {
+		t.Errorf("unexpected owner, wanted: %d:%d, got: %d:%d", srcSt.Uid, srcSt.Gid, dstSt.Uid, dstSt.Gid)
+	}
+
+	if err := copyFile(tmpdir, filepath.Join(tmpdir, "dir")); err == nil {
+		t.Errorf("expected an error copying a directory")
+	}
+}
+
+func TestExtractorDeviceNodes(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "dev/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dev/null",
+				Typeflag: tar.TypeChar,
+				Mode:     int64(0666),
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dev/loop0",
+				Typeflag: tar.TypeBlock,
+				Mode:     int64(0660),
+				Devmajor: 7,
+			},
+		},
+	}
+
+	// Both policies work without CAP_MKNOD
+	tmpdir, err := extractEntries(t, NewExtractor(WithDeviceNodes(DeviceNodesSkip)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "dev", typeflag: tar.TypeDir},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tmpdir2, err := extractEntries(t, NewExtractor(WithDeviceNodes(DeviceNodesPlaceholder), WithUmask(0)), entries)
+	defer os.RemoveAll(tmpdir2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles = []*fileInfo{
+		{path: "dev", typeflag: tar.TypeDir},
+		{path: "dev/null", typeflag: tar.TypeReg, mode: 0666},
+		{path: "dev/loop0", typeflag: tar.TypeReg, mode: 0660},
+	}
+	if err := checkExpectedFiles(tmpdir2, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorOverwriteDeviceNode(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("mknod requires root. Disabling test.")
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "null",
+				Typeflag: tar.TypeChar,
+				Mode:     int64(0666),
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+	}
+	for _, tt := range []struct {
+		policy OverwritePolicy
+		err    bool
+		minor  int64
+	}{
+		{OverwriteReplace, false, 3},
+		{OverwriteSkip, false, 5},
+		{OverwriteFail, true, 5},
+	} {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		// Left by a previous extraction
+		p := filepath.Join(tmpdir, "null")
+		if err := mknod(p, os.ModeDevice|os.ModeCharDevice|0666, 1, 5); err != nil {
+			t.Skipf("mknod not permitted: %v. Disabling test.", err)
+		}
+
+		err = extractEntriesInto(t, NewExtractor(WithOverwrite(tt.policy)), entries, tmpdir)
+		if tt.err != (err != nil) {
+			t.Errorf("policy %d: unexpected error: %v", tt.policy, err)
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Mode()&os.ModeCharDevice == 0 {
+			t.Errorf("policy %d: expected a char device, got mode %v", tt.policy, info.Mode())
+			continue
+		}
+		dev, err := mkdev(1, tt.minor)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rdev := uint64(info.Sys().(*syscall.Stat_t).Rdev); rdev != dev {
+			t.Errorf("policy %d: expected device 1:%d, got %#x", tt.policy, tt.minor, rdev)
+		}
+	}
+}
+
+// existingNodeFS is a fakeFS where an entry with the given mode appears at a
+// path when the first device node is created there.
+type existingNodeFS struct {
+	*fakeFS
+	mode os.FileMode
+	done bool
+}
+
+func (fs *existingNodeFS) Mknod(name string, mode os.FileMode, major, minor int64) error {
+	if !fs.done {
+		fs.done = true
+		if _, err := fs.create(name, fs.mode); err != nil {
+			return err
+		}
+	}
+	return fs.fakeFS.Mknod(name, mode, major, minor)
+}
+
+func TestExtractorDeviceNodeExists(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "null",
+				Typeflag: tar.TypeChar,
+				Mode:     int64(0666),
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	for _, tt := range []struct {
+		policy OverwritePolicy
+		mode   os.FileMode
+		err    bool
+		// replaced is whether the entry is replaced by the device node
+		replaced bool
+	}{
+		{OverwriteReplace, os.ModeDevice | os.ModeCharDevice | 0600, false, true},
+		{OverwriteReplace, 0644, false, true},
+		{OverwriteReplace, os.ModeDir | 0755, true, false},
+		{OverwriteSkip, os.ModeDevice | os.ModeCharDevice | 0600, false, false},
+		{OverwriteFail, os.ModeDevice | os.ModeCharDevice | 0600, true, false},
+	} {
+		fs := &existingNodeFS{fakeFS: newFakeFS(), mode: tt.mode}
+		e := NewExtractor(WithFS(fs), WithOverwrite(tt.policy))
+		err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake")
+		if tt.err != (err != nil) {
+			t.Errorf("policy %d, mode %v: unexpected error: %v", tt.policy, tt.mode, err)
+		}
+		f, ok := fs.files["/fake/null"]
+		if !ok {
+			t.Errorf("policy %d, mode %v: /fake/null removed", tt.policy, tt.mode)
+			continue
+		}
+		expected := tt.mode
+		if tt.replaced {
+			expected = os.ModeDevice | os.ModeCharDevice | 0666
+		}
+		if f.mode != expected {
+			t.Errorf("policy %d, mode %v: expected mode %v, got %v", tt.policy, tt.mode, expected, f.mode)
+		}
+		for _, op := range fs.ops {
+			if strings.HasPrefix(op, "removeall ") {
+				t.Errorf("policy %d, mode %v: unexpected operation %q", tt.policy, tt.mode, op)
+			}
+		}
+	}
+
+	// A non-empty directory found before creating the node isn't wiped
+	// either
+	fs := newFakeFS()
+	if err := mkdirAll(fs, "/fake/null", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := fs.create("/fake/null/keep", 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e := NewExtractor(WithFS(fs), WithOverwrite(OverwriteReplace))
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake"); err == nil {
+		t.Errorf("expected an error replacing a non-empty directory")
+	}
+	if _, ok := fs.files["/fake/null/keep"]; !ok {
+		t.Errorf("the contents of the directory were removed")
+	}
+}
+
+func TestExtractorTruncatedArchive(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: strings.Repeat("a", 1000),
+			header: &tar.Header{
+				Name: "first.txt",
+				Size: 1000,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "second.txt",
+				Size: 3,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	tests := []struct {
+		data []byte
+		name string
+	}{
+		// In the contents of the first entry
+		{data[:600], "first.txt"},
+		// In the header of the second entry
+		{data[:1536+100], "first.txt"},
+		// In the contents of the second entry, before its padding
+		{data[:2048+2], "second.txt"},
+	}
+	for _, tt := range tests {
+		tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		err = NewExtractor().Extract(tar.NewReader(bytes.NewReader(tt.data)), tmpdir)
+		var truncErr *TruncatedArchiveError
+		if !errors.As(err, &truncErr) {
+			t.Errorf("%d bytes: expected a TruncatedArchiveError, got: %v", len(tt.data), err)
+			continue
+		}
+		if truncErr.Name != tt.name {
+			t.Errorf("%d bytes: unexpected last entry, wanted: %q, got: %q", len(tt.data), tt.name, truncErr.Name)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d bytes: expected the error to wrap io.ErrUnexpectedEOF", len(tt.data))
+		}
+	}
+
+	// A corrupted header isn't reported as a truncation
+	corrupted := append([]byte(nil), data...)
+	copy(corrupted[1536:], "garbage")
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	err = NewExtractor().Extract(tar.NewReader(bytes.NewReader(corrupted)), tmpdir)
+	var truncErr *TruncatedArchiveError
+	if err == nil || errors.As(err, &truncErr) {
+		t.Errorf("expected a non truncation error, got: %v", err)
+	}
+}
+
+func TestExtractorStaging(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: strings.Repeat("a", 1000),
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 1000,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	parent, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "rootfs")
+	e := NewExtractor(WithStaging())
+
+	// A failure in the middle of the archive leaves nothing behind
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data[:1200])), dir); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if err := checkExpectedFiles(parent, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data)), dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "rootfs", typeflag: tar.TypeDir},
+		{path: "rootfs/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "rootfs/bar.txt", typeflag: tar.TypeReg, size: 1000},
+	}
+	if err := checkExpectedFiles(parent, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Only fresh directories are supported
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data)), dir); err == nil {
+		t.Errorf("expected an error extracting into a non empty directory")
+	}
+	if err := checkExpectedFiles(parent, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorFsync(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0500),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir, mode: 0500},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	// Only exercise the code paths, crash consistency can't be tested
+	for _, policy := range []FsyncPolicy{FsyncEach, FsyncOnce} {
+		tmpdir, err := extractEntries(t, NewExtractor(WithFsync(policy)), entries)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", policy, err)
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("%d: unexpected error: %v", policy, err)
+		}
+		os.Chmod(filepath.Join(tmpdir, "folder"), 0700)
+		os.RemoveAll(tmpdir)
+	}
+}
+
+func TestExtractorHeaderTransform(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "Folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "Folder/FOO",
+				Size: 3,
+				Mode: 04755,
+			},
+		},
+	}
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Name = strings.ToLower(hdr.Name)
+		hdr.Mode &^= int64(04000 | 02000)
+		return hdr, nil
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithHeaderTransform(transform)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo", typeflag: tar.TypeReg, size: 3, mode: 0755, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(tmpdir, "folder/foo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode()&os.ModeSetuid != 0 {
+		t.Errorf("unexpected setuid bit on %q", fi.Name())
+	}
+
+	// The rewritten names go through the same checks
+	escape := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Name = filepath.Join("..", hdr.Name)
+		return hdr, nil
+	}
+	tmpdir2, err := extractEntries(t, NewExtractor(WithHeaderTransform(escape)), entries)
+	defer os.RemoveAll(tmpdir2)
+	var pathErr *InsecurePathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("expected an InsecurePathError, got: %v", err)
+	}
+}
+
+func TestExtractorSanitizeModes(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "tmp/",
+				Typeflag: tar.TypeDir,
+				Mode:     01777,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "tmp/foo",
+				Size: 3,
+				Mode: 04755,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "tmp/bar",
+				Size: 3,
+				Mode: 02755,
+			},
+		},
+	}
+	for _, sticky := range []bool{false, true} {
+		tmpdir, err := extractEntries(t, NewExtractor(WithSanitizeModes(sticky), WithUmask(0)), entries)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wantDir := os.ModeDir | os.ModeSticky | 0777
+		if sticky {
+			wantDir &^= os.ModeSticky
+		}
+		for path, want := range map[string]os.FileMode{
+			"tmp":     wantDir,
+			"tmp/foo": 0755,
+			"tmp/bar": 0755,
+		} {
+			fi, err := os.Stat(filepath.Join(tmpdir, path))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fi.Mode() != want {
+				t.Errorf("%q: wrong mode, wanted %s, got %s", path, want, fi.Mode())
+			}
+		}
+	}
+}
+
+func TestExtractorManifest(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				Mode:     0777,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: 0600,
+			},
+		},
+	}
+	filter := func(hdr *tar.Header) bool {
+		return hdr.Name != "folder/bar.txt"
+	}
+	var manifest []ExtractedEntry
+	tmpdir, err := extractEntries(t, NewExtractor(WithFilter(filter), WithManifest(&manifest)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []ExtractedEntry{
+		{Name: "folder/", Typeflag: tar.TypeDir, Mode: os.ModeDir | 0755},
+		{Name: "folder/foo.txt", Typeflag: tar.TypeReg, Size: 3, Mode: 0644},
+		{Name: "folder/symlink", Typeflag: tar.TypeSymlink, Mode: os.ModeSymlink | 0777},
+		{Name: "folder/bar.txt", Typeflag: tar.TypeReg, Size: 3, Mode: 0600, Skipped: true},
+		// Hardlinks come last
+		{Name: "folder/hardlink", Typeflag: tar.TypeLink, Mode: 0644},
+	}
+	if len(manifest) != len(expected) {
+		t.Fatalf("wrong manifest, wanted %d entries, got: %+v", len(expected), manifest)
+	}
+	for i, want := range expected {
+		// The test tarball is owned by the current user
+		want.Uid, want.Gid = os.Getuid(), os.Getgid()
+		if !want.Skipped {
+			want.Path = filepath.Join(tmpdir, want.Name)
+		}
+		if manifest[i] != want {
+			t.Errorf("entry %d: wanted %+v, got %+v", i, want, manifest[i])
+		}
+	}
+}
+
+func TestExtractorManifestPath(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "/project-1.2.3/./src//foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "project-1.2.3/src/.wh.bar.txt",
+			},
+		},
+	}
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Name = strings.Replace(hdr.Name, "src", "lib", 1)
+		return hdr, nil
+	}
+	var manifest []ExtractedEntry
+	e := NewExtractor(WithStripComponents(1), WithHeaderTransform(transform), WithWhiteouts(), WithManifest(&manifest))
+	tmpdir, err := extractEntries(t, e, entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	if want := filepath.Join(tmpdir, "lib/foo.txt"); manifest[0].Path != want {
+		t.Errorf("unexpected path, wanted: %q, got: %q", want, manifest[0].Path)
+	}
+	if _, err := os.Stat(manifest[0].Path); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if manifest[1].Path != "" {
+		t.Errorf("expected no path for the whiteout, got: %q", manifest[1].Path)
+	}
+}
+
+func TestExtractorStats(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "folder/hello.txt",
+				Size: 5,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/null",
+				Typeflag: tar.TypeChar,
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/fifo",
+				Typeflag: tar.TypeFifo,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "folder/.wh.gone",
+			},
+		},
+		{
+			contents: "skip",
+			header: &tar.Header{
+				Name: "folder/skipped.txt",
+				Size: 4,
+			},
+		},
+	}
+	filter := func(hdr *tar.Header) bool {
+		return hdr.Name != "folder/skipped.txt"
+	}
+	var stats Stats
+	e := NewExtractor(WithFilter(filter), WithWhiteouts(), WithDeviceNodes(DeviceNodesPlaceholder), WithStats(&stats))
+	tmpdir, err := extractEntries(t, e, entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Stats{
+		Files:        2,
+		Dirs:         1,
+		Symlinks:     1,
+		Hardlinks:    1,
+		Devices:      1,
+		Fifos:        1,
+		Whiteouts:    1,
+		Skipped:      1,
+		BytesWritten: 8,
+		BytesSkipped: 4,
+	}
+	if stats != expected {
+		t.Errorf("unexpected stats, wanted: %+v, got: %+v", expected, stats)
+	}
+}
+
+func TestExtractorDigest(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	var manifest []ExtractedEntry
+	tmpdir, err := extractEntries(t, NewExtractor(WithDigest(sha256.New), WithManifest(&manifest)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("wrong manifest, wanted 2 entries, got: %+v", manifest)
+	}
+	if manifest[0].Digest != "" {
+		t.Errorf("unexpected digest for %q: %s", manifest[0].Name, manifest[0].Digest)
+	}
+	want := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if manifest[1].Digest != want {
+		t.Errorf("wrong digest for %q, wanted %s, got %s", manifest[1].Name, want, manifest[1].Digest)
+	}
+}
+
+func TestExtractorLogger(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	filter := func(hdr *tar.Header) bool {
+		return hdr.Name != "bar.txt"
+	}
+	for _, tt := range []struct {
+		verbosity LogLevel
+		expected  []string
+	}{
+		{LogNotices, []string{`skipped "bar.txt"`}},
+		{LogEntries, []string{`extracted "foo.txt"`, `skipped "bar.txt"`}},
+	} {
+		var lines []string
+		logger := func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+		tmpdir, err := extractEntries(t, NewExtractor(WithFilter(filter), WithLogger(logger, tt.verbosity)), entries)
+		os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Join(lines, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("verbosity %d: wrong log, wanted %q, got %q", tt.verbosity, tt.expected, lines)
+		}
+	}
+}
+
+func TestExtractorContinueOnError(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			// foo.txt is not a directory
+			contents: "bar",
+			header: &tar.Header{
+				Name: "foo.txt/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "baz.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithContinueOnError()), entries)
+	defer os.RemoveAll(tmpdir)
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("expected a MultiError, got: %v", err)
+	}
+	if len(multiErr.Errors) != 1 || !strings.Contains(multiErr.Errors[0].Error(), "foo.txt/bar.txt") {
+		t.Errorf("unexpected errors: %v", multiErr.Errors)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "baz.txt", typeflag: tar.TypeReg, size: 3, contents: "baz"},
+		{path: "hardlink", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Insecure entries still abort the extraction
+	entries = append([]*testTarEntry{{header: &tar.Header{Name: "../evil", Typeflag: tar.TypeDir}}}, entries...)
+	tmpdir2, err := extractEntries(t, NewExtractor(WithContinueOnError()), entries)
+	defer os.RemoveAll(tmpdir2)
+	var pathErr *InsecurePathError
+	if !errors.As(err, &pathErr) {
+		t.Fatalf("expected an InsecurePathError, got: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir2, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorOverwriteRegularFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	p := filepath.Join(tmpdir, "foo.txt")
+	if err := ioutil.WriteFile(p, []byte("a much longer content"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+				Mode: 04751,
+			},
+		},
+	}
+	if err := extractEntriesInto(t, NewExtractor(WithUmask(0)), entries, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, mode: 0751, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := os.ModeSetuid | 0751; info.Mode() != want {
+		t.Errorf("wrong mode, wanted %s, got %s", want, info.Mode())
+	}
+}
+
+func TestExtractorDefaultDirMode(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0700,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "other/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithDefaultDirMode(0750), WithUmask(0)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir, mode: 0700},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "other", typeflag: tar.TypeDir, mode: 0750},
+		{path: "other/bar.txt", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorInvalidNames(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "foo",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "bar",
+			},
+		},
+	}
+	// archive/tar can't write names with a NUL byte, inject them
+	for _, transform := range []HeaderTransform{
+		func(hdr *tar.Header) (*tar.Header, error) {
+			hdr.Name = "foo\x00bar"
+			return hdr, nil
+		},
+		func(hdr *tar.Header) (*tar.Header, error) {
+			hdr.Linkname = "bar\x00baz"
+			return hdr, nil
+		},
+	} {
+		tmpdir, err := extractEntries(t, NewExtractor(WithHeaderTransform(transform)), entries)
+		defer os.RemoveAll(tmpdir)
+		var nameErr *InvalidNameError
+		if !errors.As(err, &nameErr) || nameErr.Absolute {
+			t.Errorf("expected an InvalidNameError, got: %v", err)
+		}
+		if err := checkExpectedFiles(tmpdir, nil); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestExtractorAbsolutePaths(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "/etc/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	// The leading slash is stripped by default
+	tmpdir, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tmpdir2, err := extractEntries(t, NewExtractor(WithAbsolutePaths(AbsolutePathsReject)), entries)
+	defer os.RemoveAll(tmpdir2)
+	var nameErr *InvalidNameError
+	if !errors.As(err, &nameErr) || !nameErr.Absolute {
+		t.Fatalf("expected an InvalidNameError, got: %v", err)
+	}
+	if nameErr.Name != "/etc/foo.txt" {
+		t.Errorf("unexpected name in error, wanted: %q, got: %q", "/etc/foo.txt", nameErr.Name)
+	}
+	if err := checkExpectedFiles(tmpdir2, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorSkipAppleDouble(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "rsrc",
+			header: &tar.Header{
+				Name: "folder/._foo.txt",
+				Size: 4,
+			},
+		},
+		{
+			contents: "rsrc",
+			header: &tar.Header{
+				Name: "./._folder",
+				Size: 4,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "__MACOSX/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "rsrc",
+			header: &tar.Header{
+				Name: "__MACOSX/folder/._foo.txt",
+				Size: 4,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithSkipAppleDouble()), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorConcurrency(t *testing.T) {
+	var entries []*testTarEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, &testTarEntry{
+			header: &tar.Header{
+				Name:     fmt.Sprintf("dir%d/", i),
+				Typeflag: tar.TypeDir,
+				Mode:     0750,
+			},
+		})
+		for j := 0; j < 20; j++ {
+			contents := strings.Repeat(fmt.Sprintf("%d-%d ", i, j), 1000*j)
+			entries = append(entries, &testTarEntry{
+				contents: contents,
+				header: &tar.Header{
+					Name: fmt.Sprintf("dir%d/file%d", i, j),
+					Size: int64(len(contents)),
+					Mode: 0600 + int64(j%2)*0100,
+				},
+			})
+		}
+	}
+	// Entries depending on the files written concurrently
+	entries = append(entries,
+		&testTarEntry{
+			contents: "replaced",
+			header: &tar.Header{
+				Name: "dir0/file1",
+				Size: 8,
+			},
+		},
+		&testTarEntry{
+			header: &tar.Header{
+				Name:     "dir1/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "dir1/file2",
+			},
+		},
+		&testTarEntry{
+			header: &tar.Header{
+				Name:     "dir2/file3/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+	)
+
+	seqdir, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(seqdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := make(map[string]*fileInfo)
+	err = filepath.Walk(seqdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == seqdir {
+			return err
+		}
+		relpath := path[len(seqdir)+1:]
+		fi := &fileInfo{path: relpath, typeflag: tar.TypeDir, mode: info.Mode().Perm()}
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fi.typeflag = tar.TypeReg
+			fi.size = info.Size()
+			fi.contents = string(data)
+		}
+		expectedFiles[relpath] = fi
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(WithConcurrency(4)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkExpectedFiles(tmpdir, expectedFiles); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorConcurrencyReplacedDir(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	contents := strings.Repeat("x", 64*1024)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "dir/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+	}
+	for i := 0; i < 64; i++ {
+		entries = append(entries, &testTarEntry{
+			contents: contents,
+			header: &tar.Header{
+				Name: fmt.Sprintf("dir/file%d", i),
+				Size: int64(len(contents)),
+			},
+		})
+	}
+	// Replacing dir must wait for the files written inside it, or they
+	// could be written through the symlink. Once they're written, dir
+	// isn't empty and the symlink can't replace it.
+	entries = append(entries, &testTarEntry{
+		header: &tar.Header{
+			Name:     "dir",
+			Typeflag: tar.TypeSymlink,
+			Linkname: outside,
+		},
+	})
+	for i := 0; i < 10; i++ {
+		tmpdir, err := extractEntries(t, NewExtractor(WithConcurrency(8)), entries)
+		defer os.RemoveAll(tmpdir)
+		if err == nil {
+			t.Fatalf("expected an error replacing the directory")
+		}
+		info, err := os.Lstat(filepath.Join(tmpdir, "dir"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !info.IsDir() {
+			t.Errorf("expected dir to be kept, got mode %v", info.Mode())
+		}
+	}
+	infos, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("expected nothing to be written through the symlink, got: %d files", len(infos))
+	}
+}
+
+func TestExtractorCopyBuffer(t *testing.T) {
+	contents := strings.Repeat("0123456789", 10000)
+	entries := []*testTarEntry{
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: int64(len(contents)),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	// Also below the minimum size
+	for _, size := range []int{1, 4096, 1 << 20} {
+		tmpdir, err := extractEntries(t, NewExtractor(WithCopyBuffer(size)), entries)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", size, err)
+		}
+		expectedFiles := []*fileInfo{
+			{path: "foo.txt", typeflag: tar.TypeReg, size: int64(len(contents)), contents: contents},
+			{path: "bar.txt", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+		}
+		if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+			t.Errorf("%d: unexpected error: %v", size, err)
+		}
+	}
+}
+
+func BenchmarkExtractorCopyBuffer(b *testing.B) {
+	const size = 64 << 20
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "big", Mode: 0644, Size: size}); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := io.CopyN(tw, strings.NewReader(strings.Repeat("x", size)), size); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	data := buf.Bytes()
+
+	for _, bufSize := range []int{0, 4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", bufSize>>10), func(b *testing.B) {
+			var opts []Option
+			if bufSize > 0 {
+				opts = append(opts, WithCopyBuffer(bufSize))
+			}
+			e := NewExtractor(opts...)
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+				if err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				if err := e.Extract(tar.NewReader(bytes.NewReader(data)), tmpdir); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				os.RemoveAll(tmpdir)
+			}
+		})
+	}
+}
+
+func TestExtractorFallocate(t *testing.T) {
+	contents := strings.Repeat("fallocate", 10000)
+	entries := []*testTarEntry{
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "folder/big",
+				Size: int64(len(contents)),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "folder/empty",
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithFallocate()), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/big", typeflag: tar.TypeReg, size: int64(len(contents)), contents: contents},
+		{path: "folder/empty", typeflag: tar.TypeReg},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorDirSpecialBits(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "tmp/",
+				Typeflag: tar.TypeDir,
+				Mode:     01777,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "tmp/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			// Created as a parent first
+			contents: "bar",
+			header: &tar.Header{
+				Name: "shared/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "shared/",
+				Typeflag: tar.TypeDir,
+				Mode:     03775,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithUmask(0)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for path, want := range map[string]os.FileMode{
+		"tmp":    os.ModeDir | os.ModeSticky | 0777,
+		"shared": os.ModeDir | os.ModeSticky | os.ModeSetgid | 0775,
+	} {
+		info, err := os.Stat(filepath.Join(tmpdir, path))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%q: wrong mode, wanted %s, got %s", path, want, info.Mode())
+		}
+	}
+}
+
+func TestExtractorVerify(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "./folder/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	const (
+		fooSum = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+		barSum = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+	)
+	for _, tt := range []struct {
+		name     string
+		expected map[string]string
+		err      *ChecksumMismatchError
+	}{
+		{
+			"match",
+			map[string]string{"folder/foo.txt": fooSum, "folder/bar.txt": barSum},
+			nil,
+		},
+		{
+			"mismatch",
+			map[string]string{"folder/foo.txt": barSum, "folder/bar.txt": barSum},
+			&ChecksumMismatchError{Name: "folder/foo.txt", Want: barSum, Got: fooSum},
+		},
+		{
+			"missing",
+			map[string]string{"folder/foo.txt": fooSum, "folder/bar.txt": barSum, "folder/baz.txt": fooSum},
+			&ChecksumMismatchError{Name: "folder/baz.txt", Want: fooSum},
+		},
+		{
+			"unexpected",
+			map[string]string{"folder/foo.txt": fooSum},
+			&ChecksumMismatchError{Name: "folder/bar.txt"},
+		},
+	} {
+		tmpdir, err := extractEntries(t, NewExtractor(WithVerify(tt.expected, sha256.New)), entries)
+		os.RemoveAll(tmpdir)
+		if tt.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		var sumErr *ChecksumMismatchError
+		if !errors.As(err, &sumErr) {
+			t.Errorf("%s: expected a ChecksumMismatchError, got: %v", tt.name, err)
+			continue
+		}
+		if *sumErr != *tt.err {
+			t.Errorf("%s: wrong error, wanted %+v, got %+v", tt.name, tt.err, sumErr)
+		}
+	}
+}
+
+func TestExtractorFinishDirs(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	entries := []*testTarEntry{
+		// Listed before its parent, whose mode doesn't allow to
+		// reach it
+		{
+			header: &tar.Header{
+				Name:     "private/sub/",
+				Typeflag: tar.TypeDir,
+				Mode:     0500,
+				ModTime:  mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "private/",
+				Typeflag: tar.TypeDir,
+				Mode:     0600,
+				ModTime:  mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "ro/",
+				Typeflag: tar.TypeDir,
+				Mode:     0500,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "ro/foo.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		// The last entry of a directory wins
+		{
+			header: &tar.Header{
+				Name:     "ro",
+				Typeflag: tar.TypeDir,
+				Mode:     0555,
+				ModTime:  mtime,
+			},
+		},
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if os.Geteuid() == 0 {
+		uid, gid = 1000, 1000
+	}
+	for _, entry := range entries {
+		entry.header.Uid, entry.header.Gid = uid, gid
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithChown(false), WithPreserveTimes()), entries)
+	defer os.RemoveAll(tmpdir)
+	defer os.Chmod(filepath.Join(tmpdir, "ro"), 0755)
+	defer os.Chmod(filepath.Join(tmpdir, "private"), 0755)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Restore the search permission of private to reach sub
+	if err := os.Chmod(filepath.Join(tmpdir, "private"), 0700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Chmod(filepath.Join(tmpdir, "private/sub"), 0755)
+
+	for _, tt := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{"private/sub", 0500},
+		{"ro", 0555},
+		{"ro/foo.txt", 0644},
+	} {
+		p := filepath.Join(tmpdir, tt.path)
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s: unexpected mode, wanted: %#o, got: %#o", tt.path, tt.mode, info.Mode().Perm())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: unexpected mtime, wanted: %v, got: %v", tt.path, mtime, info.ModTime())
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if int(st.Uid) != uid || int(st.Gid) != gid {
+			t.Errorf("%s: wrong owner, wanted %d:%d, got %d:%d", tt.path, uid, gid, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestExtractorForceOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("chown requires root. Disabling test.")
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Uid:      1000,
+				Gid:      1001,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Uid:  1002,
+				Gid:  1003,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				Uid:      1004,
+				Gid:      1005,
+			},
+		},
+	}
+	// The ids outside of the mapping would be skipped without the forced
+	// owner
+	idMap := []IDMapRange{{ContainerID: 0, HostID: 100000, Size: 10}}
+	var manifest []ExtractedEntry
+	e := NewExtractor(WithForceOwner(2000, 2001), WithIDMapping(idMap, idMap), WithManifest(&manifest))
+	tmpdir, err := extractEntries(t, e, entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range entries {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(tmpdir, entry.header.Name), &st); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if st.Uid != 2000 || st.Gid != 2001 {
+			t.Errorf("%s: wrong owner, wanted 2000:2001, got %d:%d", entry.header.Name, st.Uid, st.Gid)
+		}
+	}
+	for _, entry := range manifest {
+		if entry.Uid != 2000 || entry.Gid != 2001 || entry.Skipped {
+			t.Errorf("unexpected manifest entry: %+v", entry)
+		}
+	}
+}
+
+func TestExtractorPackageDefaultDirMode(t *testing.T) {
+	defer func(mode os.FileMode) { DefaultDirMode = mode }(DefaultDirMode)
+	DefaultDirMode = 0700
+
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir, mode: 0700},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorSkipSpecial(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "fifo",
+				Typeflag: tar.TypeFifo,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	var lines []string
+	logger := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithSkipSpecial(false), WithLogger(logger, LogNotices)), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != `skipped "fifo"` {
+		t.Errorf("unexpected log: %q", lines)
+	}
+
+	tmpdir2, err := extractEntries(t, NewExtractor(WithSkipSpecial(true)), entries)
+	defer os.RemoveAll(tmpdir2)
+	var ute *UnsupportedTypeError
+	if !errors.As(err, &ute) {
+		t.Fatalf("expected an UnsupportedTypeError, got: %v", err)
+	}
+	if ute.Name != "fifo" || ute.Type != tar.TypeFifo {
+		t.Errorf("unexpected error: %+v", ute)
+	}
+}
+
+func TestExtractorDetectCaseCollisions(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "dir/README",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "dir/readme",
+				Size: 3,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "DIR/baz.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "dir/README",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(WithDetectCaseCollisions(CaseCollisionFail)), entries)
+	defer os.RemoveAll(tmpdir)
+	var cce *CaseCollisionError
+	if !errors.As(err, &cce) {
+		t.Fatalf("expected a CaseCollisionError, got: %v", err)
+	}
+	if cce.Name != "dir/readme" || cce.Existing != "dir/README" {
+		t.Errorf("unexpected error: %+v", cce)
+	}
+
+	var lines []string
+	logger := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	tmpdir2, err := extractEntries(t, NewExtractor(WithDetectCaseCollisions(CaseCollisionSkip), WithLogger(logger, LogNotices)), entries)
+	defer os.RemoveAll(tmpdir2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "dir", typeflag: tar.TypeDir},
+		{path: "dir/README", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir2, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(lines) != 4 || lines[1] != `skipped "dir/readme"` || lines[3] != `skipped "DIR/baz.txt"` {
+		t.Errorf("unexpected log: %q", lines)
+	}
+}
+
+func TestExtractorDryRun(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "dir/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "dir/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dir/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "dir/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "dir",
+			},
+		},
+	}
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	target := filepath.Join(tmpdir, "target")
+
+	var manifest []ExtractedEntry
+	if err := extractEntriesInto(t, NewExtractor(WithDryRun(), WithManifest(&manifest)), entries, target); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest) != len(entries) {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Fatalf("the dry run created %q: %v", target, err)
+	}
+
+	// Writing through the symlink fails the same way
+	entries = append(entries, &testTarEntry{
+		contents: "bar",
+		header: &tar.Header{
+			Name: "link/evil",
+			Size: 3,
+		},
+	})
+	dryErr := extractEntriesInto(t, NewExtractor(WithDryRun()), entries, target)
+	var linkErr *InsecureLinkError
+	if !errors.As(dryErr, &linkErr) {
+		t.Fatalf("expected an InsecureLinkError, got: %v", dryErr)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Fatalf("the dry run created %q: %v", target, err)
+	}
+	err = extractEntriesInto(t, NewExtractor(), entries, target)
+	if err == nil || err.Error() != dryErr.Error() {
+		t.Errorf("expected the error of the dry run %q, got: %v", dryErr, err)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"syscall"
+)
+
+// fallocate allocates the disk space for size bytes of f. Filesystems without
+// support for it are ignored.
+func fallocate(f File, size int64) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// FS is the filesystem an Extractor creates the entries in. The names are
+// paths joined to the target directory, and the methods behave like their
+// counterparts of the os package.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	// Lchown changes the owner of name, without following symlinks.
+	Lchown(name string, uid, gid int) error
+	// Lchtimes changes the access and modification times of name,
+	// without following symlinks.
+	Lchtimes(name string, atime, mtime time.Time) error
+	// Mknod creates a device node or a fifo, as given by the type bits
+	// of mode.
+	Mknod(name string, mode os.FileMode, major, minor int64) error
+	Lstat(name string) (os.FileInfo, error)
+	// Remove removes the file or the empty directory name, without
+	// following symlinks.
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+// File is a regular file opened by a FS.
+type File interface {
+	io.WriteCloser
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+}
+
+// XattrFS is implemented by the filesystems supporting extended attributes.
+// The extended attributes can't be set on the other ones.
+type XattrFS interface {
+	// Lsetxattr sets the extended attribute attr of name, without
+	// following symlinks.
+	Lsetxattr(name, attr string, value []byte) error
+}
+
+// osFS is the FS of the operating system, used by default.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (osFS) Lchtimes(name string, atime, mtime time.Time) error {
+	ts := []syscall.Timespec{timeToTimespec(atime), timeToTimespec(mtime)}
+	err := lutimesNano(name, ts)
+	if err != ErrNotSupportedPlatform {
+		return err
+	}
+	// The times of symlinks can't be changed on this platform
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return syscall.UtimesNano(name, ts)
+}
+
+func (osFS) Mknod(name string, mode os.FileMode, major, minor int64) error {
+	if mode&os.ModeNamedPipe != 0 {
+		return mkfifo(name, mode)
+	}
+	return mknod(name, mode, major, minor)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Lsetxattr(name, attr string, value []byte) error {
+	return lsetxattr(name, attr, value)
+}
+
+// mkdirAll creates the directory p in fs with its missing parents, like
+// os.MkdirAll. The existing symlinks are assumed to point to directories.
+func mkdirAll(fs FS, p string, perm os.FileMode) error {
+	info, err := fs.Lstat(p)
+	if err == nil {
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := filepath.Dir(p); parent != p {
+		if err := mkdirAll(fs, parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := fs.Mkdir(p, perm&^os.ModeType); err != nil {
+		// Created concurrently, or the path ends with "."
+		if info, lerr := fs.Lstat(p); lerr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
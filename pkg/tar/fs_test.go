@@ -0,0 +1,333 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeFS is an in-memory FS recording the operations modifying it.
+type fakeFS struct {
+	files map[string]*fakeFile
+	ops   []string
+}
+
+type fakeFile struct {
+	name string
+	mode os.FileMode
+	data []byte
+	off  int64
+}
+
+func newFakeFS() *fakeFS {
+	return &fakeFS{files: map[string]*fakeFile{
+		"/": {name: "/", mode: os.ModeDir | 0755},
+	}}
+}
+
+func (fs *fakeFS) record(format string, args ...interface{}) {
+	fs.ops = append(fs.ops, fmt.Sprintf(format, args...))
+}
+
+func (fs *fakeFS) create(name string, mode os.FileMode) (*fakeFile, error) {
+	if _, ok := fs.files[name]; ok {
+		return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EEXIST}
+	}
+	if parent, ok := fs.files[filepath.Dir(name)]; !ok || !parent.mode.IsDir() {
+		return nil, &os.PathError{Op: "create", Path: name, Err: syscall.ENOENT}
+	}
+	f := &fakeFile{name: name, mode: mode}
+	fs.files[name] = f
+	return f, nil
+}
+
+func (fs *fakeFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.record("open %s %#o", name, perm)
+	if f, ok := fs.files[name]; ok && flag&os.O_EXCL == 0 {
+		f.data, f.off = nil, 0
+		return f, nil
+	}
+	return fs.create(name, perm)
+}
+
+func (fs *fakeFS) Mkdir(name string, perm os.FileMode) error {
+	fs.record("mkdir %s %#o", name, perm)
+	_, err := fs.create(name, os.ModeDir|perm)
+	return err
+}
+
+func (fs *fakeFS) Symlink(oldname, newname string) error {
+	fs.record("symlink %s %s", oldname, newname)
+	f, err := fs.create(newname, os.ModeSymlink|0777)
+	if err == nil {
+		f.data = []byte(oldname)
+	}
+	return err
+}
+
+func (fs *fakeFS) Link(oldname, newname string) error {
+	fs.record("link %s %s", oldname, newname)
+	f, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOENT}
+	}
+	fs.files[newname] = f
+	return nil
+}
+
+func (fs *fakeFS) Chmod(name string, mode os.FileMode) error {
+	fs.record("chmod %s %#o", name, mode.Perm())
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: syscall.ENOENT}
+	}
+	f.mode = f.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+func (fs *fakeFS) Lchown(name string, uid, gid int) error {
+	fs.record("lchown %s %d:%d", name, uid, gid)
+	return nil
+}
+
+func (fs *fakeFS) Lchtimes(name string, atime, mtime time.Time) error {
+	fs.record("lchtimes %s %d", name, mtime.Unix())
+	return nil
+}
+
+func (fs *fakeFS) Mknod(name string, mode os.FileMode, major, minor int64) error {
+	fs.record("mknod %s %s %d:%d", name, mode, major, minor)
+	_, err := fs.create(name, mode)
+	return err
+}
+
+func (fs *fakeFS) Lstat(name string) (os.FileInfo, error) {
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+	}
+	return f, nil
+}
+
+func (fs *fakeFS) Remove(name string) error {
+	fs.record("remove %s", name)
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+	}
+	if f.mode.IsDir() {
+		for p := range fs.files {
+			if strings.HasPrefix(p, name+"/") {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *fakeFS) RemoveAll(name string) error {
+	fs.record("removeall %s", name)
+	for p := range fs.files {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(fs.files, p)
+		}
+	}
+	return nil
+}
+
+func (f *fakeFile) Write(p []byte) (int, error) {
+	if end := f.off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[f.off:], p)
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *fakeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *fakeFile) Truncate(size int64) error {
+	if size > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.data = f.data[:size]
+	return nil
+}
+
+func (f *fakeFile) Sync() error  { return nil }
+func (f *fakeFile) Close() error { return nil }
+
+func (f *fakeFile) Name() string       { return filepath.Base(f.name) }
+func (f *fakeFile) Size() int64        { return int64(len(f.data)) }
+func (f *fakeFile) Mode() os.FileMode  { return f.mode }
+func (f *fakeFile) ModTime() time.Time { return time.Time{} }
+func (f *fakeFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *fakeFile) Sys() interface{}   { return nil }
+
+func TestExtractorFS(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0750,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: 0640,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/fifo",
+				Typeflag: tar.TypeFifo,
+				Mode:     0600,
+			},
+		},
+	}
+	fs := newFakeFS()
+	data := readTestTar(t, entries)
+	e := NewExtractor(WithFS(fs), WithUmask(022))
+	if err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"mkdir /fake 0755",
+		"mkdir /fake/folder 0750",
+		"chmod /fake/folder 0750",
+		"open /fake/folder/foo.txt 0640",
+		"chmod /fake/folder/foo.txt 0640",
+		"symlink foo.txt /fake/folder/symlink",
+		"mknod /fake/folder/fifo prw------- 0:0",
+		"link /fake/folder/foo.txt /fake/folder/hardlink",
+		"chmod /fake/folder 0750",
+	}
+	if strings.Join(fs.ops, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected operations, wanted:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(fs.ops, "\n"))
+	}
+	if f := fs.files["/fake/folder/hardlink"]; f == nil || string(f.data) != "foo" {
+		t.Errorf("unexpected contents of the hardlink: %+v", f)
+	}
+	if _, err := os.Lstat("/fake"); !os.IsNotExist(err) {
+		t.Errorf("the extraction touched the OS filesystem: %v", err)
+	}
+}
+
+// failingDirFS is a fakeFS failing with EPERM to restore the mode or the
+// times of dir at the end of the extraction.
+type failingDirFS struct {
+	*fakeFS
+	dir       string
+	failMode  bool
+	failTimes bool
+	// chmods and lchtimes count the calls for dir, the first ones are
+	// when creating it
+	chmods   int
+	lchtimes int
+}
+
+func (fs *failingDirFS) Chmod(name string, mode os.FileMode) error {
+	if name == fs.dir {
+		fs.chmods++
+		if fs.failMode && fs.chmods > 1 {
+			return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+		}
+	}
+	return fs.fakeFS.Chmod(name, mode)
+}
+
+func (fs *failingDirFS) Lchtimes(name string, atime, mtime time.Time) error {
+	if name == fs.dir {
+		fs.lchtimes++
+		if fs.failTimes && fs.lchtimes > 1 {
+			return &os.PathError{Op: "lchtimes", Path: name, Err: syscall.EPERM}
+		}
+	}
+	return fs.fakeFS.Lchtimes(name, atime, mtime)
+}
+
+func TestExtractorFinishDirsErrors(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0750,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	for _, tt := range []struct {
+		op        string
+		failMode  bool
+		failTimes bool
+	}{
+		{"chmod", true, false},
+		{"lchtimes", false, true},
+	} {
+		fs := &failingDirFS{fakeFS: newFakeFS(), dir: "/fake/folder", failMode: tt.failMode, failTimes: tt.failTimes}
+		e := NewExtractor(WithFS(fs), WithPreserveTimes())
+		err := e.Extract(tar.NewReader(bytes.NewReader(data)), "/fake")
+		if !errors.Is(err, syscall.EPERM) {
+			t.Errorf("%s: expected EPERM, got %v", tt.op, err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.op+" ") {
+			t.Errorf("%s: unexpected error: %v", tt.op, err)
+		}
+	}
+}
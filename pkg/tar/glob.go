@@ -0,0 +1,110 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// ExtractGlobFromTar extracts the regular files matching pattern from the
+// given tar, returning their contents keyed by their cleaned path. Other
+// matching entries are skipped. The pattern uses the path.Match syntax, and
+// additionally a "**" path element matches any number of path elements,
+// including none, so "**/manifest" matches "manifest" and "a/b/manifest".
+// Like with ExtractFileFromTarWithHeader, files bigger than 64MiB aren't
+// read.
+func ExtractGlobFromTar(tr *tar.Reader, pattern string) (map[string][]byte, error) {
+	// Check the pattern once, so a bad pattern fails on empty tars too
+	if _, err := matchGlob(pattern, ""); err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return files, nil
+		case nil:
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			name := path.Clean(hdr.Name)
+			match, err := matchGlob(pattern, name)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+			buf, err := ioutil.ReadAll(io.LimitReader(tr, maxFileFromTarSize+1))
+			if err != nil {
+				return nil, fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+			}
+			if int64(len(buf)) > maxFileFromTarSize {
+				return nil, ErrSizeLimitExceeded
+			}
+			files[name] = buf
+		default:
+			return nil, err
+		}
+	}
+}
+
+// matchGlob returns whether the slash separated name matches pattern, with
+// "**" path elements matching any number of path elements.
+func matchGlob(pattern, name string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return path.Match(pattern, name)
+	}
+	var names []string
+	if name != "" {
+		names = strings.Split(name, "/")
+	}
+	return matchElements(strings.Split(path.Clean(pattern), "/"), names)
+}
+
+// matchElements matches the path elements in names against the ones in
+// patterns.
+func matchElements(patterns, names []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// Try to match the rest of the pattern from every
+			// remaining position
+			for i := 0; i <= len(names); i++ {
+				match, err := matchElements(patterns[1:], names[i:])
+				if err != nil || match {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			// Validate the rest of the pattern anyway
+			_, err := path.Match(patterns[0], "")
+			return false, err
+		}
+		match, err := path.Match(patterns[0], names[0])
+		if err != nil || !match {
+			return false, err
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtractGlobFromTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "{}",
+			header: &tar.Header{
+				Name: "manifest.json",
+				Size: 2,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dir.json/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "[]",
+			header: &tar.Header{
+				Name: "dir.json/list.json",
+				Size: 2,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link.json",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "manifest.json",
+			},
+		},
+		{
+			contents: "conf",
+			header: &tar.Header{
+				Name: "rootfs/etc/foo.conf",
+				Size: 4,
+			},
+		},
+		{
+			contents: "manifest",
+			header: &tar.Header{
+				Name: "./layers/1/manifest",
+				Size: 8,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	tests := []struct {
+		pattern  string
+		expected map[string][]byte
+	}{
+		{
+			// Directories and symlinks are skipped, and "*" doesn't
+			// match separators
+			"*.json",
+			map[string][]byte{"manifest.json": []byte("{}")},
+		},
+		{
+			"rootfs/etc/*.conf",
+			map[string][]byte{"rootfs/etc/foo.conf": []byte("conf")},
+		},
+		{
+			"**/*.json",
+			map[string][]byte{
+				"manifest.json":      []byte("{}"),
+				"dir.json/list.json": []byte("[]"),
+			},
+		},
+		{
+			"**/manifest",
+			map[string][]byte{"layers/1/manifest": []byte("manifest")},
+		},
+		{
+			"rootfs/**",
+			map[string][]byte{"rootfs/etc/foo.conf": []byte("conf")},
+		},
+		{
+			"*.yaml",
+			map[string][]byte{},
+		},
+	}
+	for _, tt := range tests {
+		files, err := ExtractGlobFromTar(tar.NewReader(bytes.NewReader(data)), tt.pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(files, tt.expected) {
+			t.Errorf("%s: unexpected files, wanted: %q, got: %q", tt.pattern, tt.expected, files)
+		}
+	}
+
+	if _, err := ExtractGlobFromTar(tar.NewReader(bytes.NewReader(data)), "**/[.json"); err == nil {
+		t.Errorf("expected an error for a bad pattern")
+	}
+}
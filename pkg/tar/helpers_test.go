@@ -0,0 +1,208 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testTarEntry struct {
+	header   *tar.Header
+	contents string
+}
+
+func newTestTar(entries []*testTarEntry) (string, error) {
+	t, err := ioutil.TempFile("", "test-tar")
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+	tw := tar.NewWriter(t)
+	for _, entry := range entries {
+		if entry.header.Typeflag == tar.TypeXGlobalHeader {
+			// Only the PAX records can be set
+			if err := tw.WriteHeader(entry.header); err != nil {
+				return "", err
+			}
+			continue
+		}
+		// Add default mode
+		if entry.header.Mode == 0 {
+			if entry.header.Typeflag == tar.TypeDir {
+				entry.header.Mode = 0755
+			} else {
+				entry.header.Mode = 0644
+			}
+		}
+		// Add calling user uid and gid or tests will fail, unless
+		// the test explicitly asks for other ids
+		if entry.header.Uid == 0 && os.Getuid() > 0 {
+			entry.header.Uid = os.Getuid()
+		}
+		if entry.header.Gid == 0 && os.Getgid() > 0 {
+			entry.header.Gid = os.Getgid()
+		}
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(tw, entry.contents); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return t.Name(), nil
+}
+
+type fileInfo struct {
+	path     string
+	typeflag byte
+	size     int64
+	contents string
+	mode     os.FileMode
+}
+
+func fileInfoSliceToMap(slice []*fileInfo) map[string]*fileInfo {
+	fim := make(map[string]*fileInfo, len(slice))
+	for _, fi := range slice {
+		fim[fi.path] = fi
+	}
+	return fim
+}
+
+func checkExpectedFiles(dir string, expectedFiles map[string]*fileInfo) error {
+	files := make(map[string]*fileInfo)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		fm := info.Mode()
+		if path == dir {
+			return nil
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fm.IsRegular():
+			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeReg, size: info.Size(), mode: info.Mode().Perm()}
+		case info.IsDir():
+			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeDir, mode: info.Mode().Perm()}
+		case fm&os.ModeSymlink != 0:
+			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeSymlink, mode: info.Mode()}
+		default:
+			return fmt.Errorf("file mode not handled: %v", fm)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Set defaults for not specified expected file mode
+	for _, ef := range expectedFiles {
+		if ef.mode == 0 {
+			if ef.typeflag == tar.TypeDir {
+				ef.mode = 0755
+			} else {
+				ef.mode = 0644
+			}
+		}
+	}
+
+	for _, ef := range expectedFiles {
+		_, ok := files[ef.path]
+		if !ok {
+			return fmt.Errorf("Expected file %q not in files", ef.path)
+		}
+
+	}
+
+	for _, file := range files {
+		ef, ok := expectedFiles[file.path]
+		if !ok {
+			return fmt.Errorf("file %q not in expectedFiles", file.path)
+		}
+		if ef.typeflag != file.typeflag {
+			return fmt.Errorf("file %q: file type differs: wanted: %d, got: %d", file.path, ef.typeflag, file.typeflag)
+		}
+		if ef.typeflag == tar.TypeReg {
+			if ef.size != file.size {
+				return fmt.Errorf("file %q: size differs: wanted %d, wanted: %d", file.path, ef.size, file.size)
+			}
+			if ef.contents != "" {
+				buf, err := ioutil.ReadFile(filepath.Join(dir, file.path))
+				if err != nil {
+					return fmt.Errorf("unexpected error: %v", err)
+				}
+				if string(buf) != ef.contents {
+					return fmt.Errorf("unexpected contents, wanted: %s, got: %s", ef.contents, buf)
+				}
+
+			}
+		}
+		// Check modes but ignore symlinks
+		if ef.mode != file.mode && ef.typeflag != tar.TypeSymlink {
+			return fmt.Errorf("file %q: mode differs: wanted %#o, got: %#o", file.path, ef.mode, file.mode)
+		}
+
+	}
+	return nil
+}
+
+func readTestTar(t *testing.T, entries []*testTarEntry) []byte {
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	data, err := ioutil.ReadFile(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return data
+}
+
+// extractEntries writes entries to a test tarball and extracts it with e
+// into a new temporary directory, which is returned.
+func extractEntries(t *testing.T, e *Extractor, entries []*testTarEntry) (string, error) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tmpdir, extractEntriesInto(t, e, entries, tmpdir)
+}
+
+// extractEntriesInto writes entries to a test tarball and extracts it with e
+// into dir.
+func extractEntriesInto(t *testing.T, e *Extractor, entries []*testTarEntry, dir string) error {
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	return e.Extract(tar.NewReader(containerTar), dir)
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import "archive/tar"
+
+// IDMapRange maps a range of Size ids starting at ContainerID to the range
+// starting at HostID, like a line of /proc/<pid>/uid_map.
+type IDMapRange struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// mapID translates id through the ranges. It returns false if id isn't in
+// any of them.
+func mapID(ranges []IDMapRange, id int) (int, bool) {
+	if id < 0 {
+		return 0, false
+	}
+	for _, r := range ranges {
+		if uint64(id) >= uint64(r.ContainerID) && uint64(id) < uint64(r.ContainerID)+uint64(r.Size) {
+			return int(uint64(r.HostID) + uint64(id) - uint64(r.ContainerID)), true
+		}
+	}
+	return 0, false
+}
+
+// mapHeaderIDs returns a copy of hdr with its uid and gid translated through
+// the mappings. A nil mapping leaves the id unchanged. It returns nil if an
+// id isn't mapped.
+func mapHeaderIDs(hdr *tar.Header, uidMap, gidMap []IDMapRange) *tar.Header {
+	h := *hdr
+	var ok bool
+	if uidMap != nil {
+		if h.Uid, ok = mapID(uidMap, hdr.Uid); !ok {
+			return nil
+		}
+	}
+	if gidMap != nil {
+		if h.Gid, ok = mapID(gidMap, hdr.Gid); !ok {
+			return nil
+		}
+	}
+	return &h
+}
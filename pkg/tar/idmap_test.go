@@ -0,0 +1,101 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMapID(t *testing.T) {
+	ranges := []IDMapRange{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+		{ContainerID: 1000, HostID: 1000, Size: 1},
+	}
+	tests := []struct {
+		id     int
+		mapped int
+		ok     bool
+	}{
+		{0, 100000, true},
+		{999, 100999, true},
+		{1000, 1000, true},
+		{1001, 0, false},
+		{-1, 0, false},
+	}
+	for _, tt := range tests {
+		mapped, ok := mapID(ranges, tt.id)
+		if mapped != tt.mapped || ok != tt.ok {
+			t.Errorf("%d: wanted: %d %t, got: %d %t", tt.id, tt.mapped, tt.ok, mapped, ok)
+		}
+	}
+}
+
+func TestExtractorIDMapping(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	// newTestTar replaces the zero ids with the ones of the current user
+	transform := func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Uid, hdr.Gid = 0, 0
+		if hdr.Name == "bar.txt" {
+			hdr.Uid = 70000
+		}
+		return hdr, nil
+	}
+	type owner struct{ uid, gid int }
+	owners := make(map[string]owner)
+	editor := func(p string, uid, gid int, _ byte, _ os.FileInfo) error {
+		owners[filepath.Base(p)] = owner{uid, gid}
+		return nil
+	}
+	idMap := []IDMapRange{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	e := NewExtractor(
+		WithHeaderTransform(transform),
+		WithIDMapping(idMap, idMap),
+		WithPermissionsEditor(editor),
+	)
+	tmpdir, err := extractEntries(t, e, entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if o := owners["foo.txt"]; o.uid != 100000 || o.gid != 100000 {
+		t.Errorf("unexpected owner, wanted: 100000:100000, got: %d:%d", o.uid, o.gid)
+	}
+	// The uid of bar.txt isn't mapped
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
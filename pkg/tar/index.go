@@ -0,0 +1,118 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// blockSize is the size of the blocks of a tar archive.
+const blockSize = 512
+
+// Index gives random access to the entries of a tar archive.
+type Index struct {
+	ra      io.ReaderAt
+	size    int64
+	entries map[string]*IndexEntry
+}
+
+// IndexEntry describes an entry of an indexed tar archive.
+type IndexEntry struct {
+	Header *tar.Header
+	// HeaderOffset is the offset of the first header block of the entry,
+	// including the PAX and GNU extended headers
+	HeaderOffset int64
+	// BodyOffset is the offset of the contents of the entry
+	BodyOffset int64
+	// Size is the size of the contents of the entry
+	Size int64
+}
+
+// BuildIndex reads the headers of the uncompressed tar archive of the given
+// size read from ra, skipping over the contents of the entries, and returns
+// an Index of its entries. When an archive contains several entries with the
+// same name, the last one is indexed.
+func BuildIndex(ra io.ReaderAt, size int64) (*Index, error) {
+	sr := io.NewSectionReader(ra, 0, size)
+	// archive/tar seeks over the contents of the entries
+	tr := tar.NewReader(sr)
+	idx := &Index{ra: ra, size: size, entries: make(map[string]*IndexEntry)}
+	var next int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		entry := &IndexEntry{
+			Header:       hdr,
+			HeaderOffset: next,
+			BodyOffset:   body,
+			Size:         hdr.Size,
+		}
+		end := body + hdr.Size
+		if isSparse(hdr) {
+			// The size of the contents in the archive isn't known,
+			// read them to find the next header
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, err
+			}
+			if end, err = sr.Seek(0, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		next = (end + blockSize - 1) / blockSize * blockSize
+		idx.entries[filepath.Clean(hdr.Name)] = entry
+	}
+}
+
+// Lookup returns the IndexEntry of the entry with the given name.
+func (idx *Index) Lookup(name string) (*IndexEntry, bool) {
+	entry, ok := idx.entries[filepath.Clean(name)]
+	return entry, ok
+}
+
+// Open returns a reader of the contents of the regular file with the given
+// name.
+func (idx *Index) Open(name string) (io.ReadCloser, error) {
+	entry, ok := idx.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("file %q not found", name)
+	}
+	switch entry.Header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+	default:
+		return nil, fmt.Errorf("requested file %q not a regular file", name)
+	}
+	if isSparse(entry.Header) {
+		// Let archive/tar read the sparse map
+		tr := tar.NewReader(io.NewSectionReader(idx.ra, entry.HeaderOffset, idx.size-entry.HeaderOffset))
+		if _, err := tr.Next(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(tr), nil
+	}
+	return ioutil.NopCloser(io.NewSectionReader(idx.ra, entry.BodyOffset, entry.Size)), nil
+}
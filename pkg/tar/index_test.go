@@ -0,0 +1,102 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	contents := map[string]string{
+		"folder/foo.txt":                       "foo",
+		"folder/empty":                         "",
+		"folder/big":                           strings.Repeat("big", 1000),
+		"folder/" + strings.Repeat("long", 40): "long name",
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	var names []string
+	for name, data := range contents {
+		names = append(names, name)
+		entries = append(entries, &testTarEntry{
+			contents: data,
+			header: &tar.Header{
+				Name: name,
+				Size: int64(len(data)),
+			},
+		})
+	}
+	data := readTestTar(t, entries)
+	idx, err := BuildIndex(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	for _, name := range append(names, names...) {
+		rc, err := idx.Open(name)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+			continue
+		}
+		if string(b) != contents[name] {
+			t.Errorf("%q: wrong contents, wanted %q, got %q", name, contents[name], b)
+		}
+	}
+
+	entry, ok := idx.Lookup("./folder/foo.txt")
+	if !ok {
+		t.Fatalf("entry not found")
+	}
+	// The header of the entry can be read again from its offset
+	tr := tar.NewReader(bytes.NewReader(data[entry.HeaderOffset:]))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hdr.Name != "folder/foo.txt" {
+		t.Errorf("unexpected header at offset %d: %q", entry.HeaderOffset, hdr.Name)
+	}
+
+	for _, name := range []string{"folder", "folder/symlink", "missing"} {
+		if _, err := idx.Open(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import "runtime"
+
+// makedevFunc returns the device number major:minor, and false when it can't
+// be represented.
+type makedevFunc func(major, minor uint64) (uint64, bool)
+
+// makedevs contains the encodings of the device numbers, by GOOS. They're
+// the ones of the makedev macro of the C library of each platform.
+var makedevs = map[string]makedevFunc{
+	"linux":     makedevLinux,
+	"android":   makedevLinux,
+	"darwin":    makedevDarwin,
+	"ios":       makedevDarwin,
+	"freebsd":   makedevFreeBSD,
+	"netbsd":    makedevNetBSD,
+	"openbsd":   makedevOpenBSD,
+	"dragonfly": makedevDragonFly,
+}
+
+// platformMakedev returns the encoding of the device numbers of the current
+// platform, or nil when it isn't known.
+func platformMakedev() makedevFunc {
+	return makedevs[runtime.GOOS]
+}
+
+// makedevLinux is gnu_dev_makedev of glibc: 32 bits major and minor numbers,
+// with the 12 and 20 low bits of the old encoding first.
+func makedevLinux(major, minor uint64) (uint64, bool) {
+	if major > 0xffffffff || minor > 0xffffffff {
+		return 0, false
+	}
+	return minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32, true
+}
+
+// makedevDarwin encodes an 8 bits major and a 24 bits minor number in a 32
+// bits dev_t.
+func makedevDarwin(major, minor uint64) (uint64, bool) {
+	if major > 0xff || minor > 0xffffff {
+		return 0, false
+	}
+	return major<<24 | minor, true
+}
+
+// makedevFreeBSD is the 64 bits dev_t of FreeBSD 12, with 32 bits major and
+// minor numbers.
+func makedevFreeBSD(major, minor uint64) (uint64, bool) {
+	if major > 0xffffffff || minor > 0xffffffff {
+		return 0, false
+	}
+	return (major&0xffffff00)<<32 | (major&0xff)<<8 | (minor&0xff00)<<24 | minor&0xffff00ff, true
+}
+
+// makedevNetBSD encodes a 12 bits major and a 20 bits minor number.
+func makedevNetBSD(major, minor uint64) (uint64, bool) {
+	if major > 0xfff || minor > 0xfffff {
+		return 0, false
+	}
+	return (major<<8)&0x000fff00 | (minor<<12)&0xfff00000 | minor&0x000000ff, true
+}
+
+// makedevOpenBSD encodes an 8 bits major and a 24 bits minor number.
+func makedevOpenBSD(major, minor uint64) (uint64, bool) {
+	if major > 0xff || minor > 0xffffff {
+		return 0, false
+	}
+	return (major&0xff)<<8 | minor&0xff | (minor&0xffff00)<<8, true
+}
+
+// makedevDragonFly encodes an 8 bits major number in the second byte of the
+// minor one, which can't use it.
+func makedevDragonFly(major, minor uint64) (uint64, bool) {
+	if major > 0xff || minor&^0xffff00ff != 0 {
+		return 0, false
+	}
+	return major<<8 | minor, true
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import "testing"
+
+func TestMakedev(t *testing.T) {
+	type devTest struct {
+		major, minor uint64
+		dev          uint64
+		ok           bool
+	}
+	// Values of the makedev macro of the C library of each platform
+	tests := map[string][]devTest{
+		"linux": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x103, true},
+			{8, 1, 0x801, true},
+			{253, 0, 0xfd00, true},
+			{4095, 255, 0xfffff, true},
+			{0, 256, 0x100000, true},
+			{259, 65536, 0x10010300, true},
+			{4096, 0, 0x100000000000, true},
+			{0xffffffff, 0xffffffff, 0xffffffffffffffff, true},
+			{0x100000000, 0, 0, false},
+		},
+		"darwin": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x1000003, true},
+			{8, 1, 0x8000001, true},
+			{0, 256, 0x100, true},
+			{255, 0xffffff, 0xffffffff, true},
+			{256, 0, 0, false},
+			{0, 0x1000000, 0, false},
+		},
+		"freebsd": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x103, true},
+			{0, 256, 0x100000000, true},
+			{259, 65536, 0x10000010300, true},
+			{4096, 0, 0x100000000000, true},
+			{0xffffffff, 0xffffffff, 0xffffffffffffffff, true},
+			{0x100000000, 0, 0, false},
+		},
+		"netbsd": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x103, true},
+			{0, 256, 0x100000, true},
+			{4095, 0xfffff, 0xffffffff, true},
+			{4096, 0, 0, false},
+			{0, 0x100000, 0, false},
+		},
+		"openbsd": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x103, true},
+			{0, 256, 0x10000, true},
+			{255, 0xffffff, 0xffffffff, true},
+			{256, 0, 0, false},
+			{0, 0x1000000, 0, false},
+		},
+		"dragonfly": {
+			{0, 0, 0x0, true},
+			{1, 3, 0x103, true},
+			{0, 0x10000, 0x10000, true},
+			{255, 0xffff00ff, 0xffffffff, true},
+			{256, 0, 0, false},
+			{0, 256, 0, false},
+		},
+	}
+	for goos, tests := range tests {
+		makedev, ok := makedevs[goos]
+		if !ok {
+			t.Errorf("%s: no encoding", goos)
+			continue
+		}
+		for _, tt := range tests {
+			dev, ok := makedev(tt.major, tt.minor)
+			if ok != tt.ok {
+				t.Errorf("%s: %d:%d: expected ok to be %v, got %v", goos, tt.major, tt.minor, tt.ok, ok)
+				continue
+			}
+			if dev != tt.dev {
+				t.Errorf("%s: %d:%d: unexpected device number, wanted: %#x, got: %#x", goos, tt.major, tt.minor, tt.dev, dev)
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// mergeEntry is an entry of the tarball written by MergeTars.
+type mergeEntry struct {
+	hdr *tar.Header
+	// layer is the index of the layer the entry comes from
+	layer int
+	// offset is the offset of the contents of a regular file in the
+	// spool file
+	offset int64
+}
+
+// merger holds the state of MergeTars.
+type merger struct {
+	entries map[string]*mergeEntry
+	// spool holds the contents of the regular files
+	spool *os.File
+	size  int64
+}
+
+// MergeTars writes to out a tarball of the tree resulting from the extraction
+// of the given layers in order, with their whiteouts applied as with
+// WithWhiteouts. The later entries replace the earlier ones with the same
+// cleaned path, and the whiteouts aren't written. The headers of the entries
+// are kept, with their cleaned path as name. The regular files are written
+// first in lexical order, followed by the hardlinks; a hardlink whose target
+// is removed by a later layer takes its place. The contents of the regular
+// files are stored in a temporary file while the layers are read.
+func MergeTars(out io.Writer, layers ...*tar.Reader) error {
+	spool, err := ioutil.TempFile("", "rkt-merge-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	m := &merger{
+		entries: make(map[string]*mergeEntry),
+		spool:   spool,
+	}
+	for i, tr := range layers {
+		if err := m.apply(i, tr); err != nil {
+			return fmt.Errorf("could not merge layer %d: %w", i, err)
+		}
+	}
+	return m.write(out)
+}
+
+// apply adds the entries of the tarball read from tr, the layer-th one.
+func (m *merger) apply(layer int, tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := cleanEntryPath(hdr.Name)
+		if !ok {
+			return &InsecurePathError{Name: hdr.Name, Dir: "."}
+		}
+		if isWhiteout(hdr) {
+			parent := path.Dir(name)
+			base := path.Base(name)
+			if base == whiteoutOpaque {
+				m.removeChildren(parent, layer)
+				continue
+			}
+			hidden := strings.TrimPrefix(base, whiteoutPrefix)
+			if hidden == "" || hidden == "." || hidden == ".." {
+				return fmt.Errorf("invalid whiteout %q", hdr.Name)
+			}
+			m.remove(path.Join(parent, hidden), layer)
+			continue
+		}
+		if isOpaqueDir(hdr) {
+			m.removeChildren(name, layer)
+			hdr = withoutOpaqueXattr(hdr)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			continue
+		case tar.TypeLink:
+			target, ok := cleanEntryPath(hdr.Linkname)
+			if !ok {
+				return &InsecureLinkError{Path: hdr.Name, Link: hdr.Linkname, Type: hdr.Typeflag}
+			}
+			h := *hdr
+			h.Linkname = target
+			hdr = &h
+		}
+
+		// A directory is merged with an existing one, the other entries
+		// replace what's at their path
+		if old, ok := m.entries[name]; ok && (old.hdr.Typeflag != tar.TypeDir || hdr.Typeflag != tar.TypeDir) {
+			m.remove(name, layer+1)
+		}
+		entry := &mergeEntry{hdr: mergedHeader(hdr, name), layer: layer, offset: m.size}
+		n, err := io.Copy(m.spool, tr)
+		if err != nil {
+			return fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+		}
+		m.size += n
+		m.entries[name] = entry
+	}
+}
+
+// removeChildren removes the contents of the directory dir that come from
+// the layers below the given one.
+func (m *merger) removeChildren(dir string, layer int) {
+	var names []string
+	for name, entry := range m.entries {
+		if entry.layer < layer && isChildPath(dir, name) {
+			names = append(names, name)
+		}
+	}
+	m.removeAll(names)
+}
+
+// remove removes the entry at p, with its contents, when it comes from the
+// layers below the given one.
+func (m *merger) remove(p string, layer int) {
+	var names []string
+	for name, entry := range m.entries {
+		if entry.layer < layer && (name == p || isChildPath(p, name)) {
+			names = append(names, name)
+		}
+	}
+	m.removeAll(names)
+}
+
+// removeAll removes the entries with the given names. The hardlinks to a
+// removed regular file are kept: the first one becomes the regular file and
+// the others link to it.
+func (m *merger) removeAll(names []string) {
+	removed := make(map[string]*mergeEntry, len(names))
+	for _, name := range names {
+		removed[name] = m.entries[name]
+		delete(m.entries, name)
+	}
+	links := make(map[string][]string)
+	for name, entry := range m.entries {
+		if entry.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		if _, ok := removed[entry.hdr.Linkname]; ok {
+			links[entry.hdr.Linkname] = append(links[entry.hdr.Linkname], name)
+		}
+	}
+	for target, names := range links {
+		sort.Strings(names)
+		first := m.entries[names[0]]
+		h := *removed[target].hdr
+		h.Name = first.hdr.Name
+		first.hdr = &h
+		first.offset = removed[target].offset
+		for _, name := range names[1:] {
+			m.entries[name].hdr.Linkname = names[0]
+		}
+	}
+}
+
+// write writes the merged entries to out.
+func (m *merger) write(out io.Writer) error {
+	var names, links []string
+	for name, entry := range m.entries {
+		if entry.hdr.Typeflag == tar.TypeLink {
+			links = append(links, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	// The parent directories come before their contents
+	sort.Strings(names)
+	sort.Strings(links)
+	tw := tar.NewWriter(out)
+	for _, name := range append(names, links...) {
+		entry := m.entries[name]
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			return err
+		}
+		if entry.hdr.Typeflag != tar.TypeReg || entry.hdr.Size == 0 {
+			continue
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(m.spool, entry.offset, entry.hdr.Size)); err != nil {
+			return fmt.Errorf("could not write file %q: %w", name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// mergedHeader returns a copy of hdr with the given cleaned name, to be
+// written by MergeTars. Sparse files are written as regular files.
+func mergedHeader(hdr *tar.Header, name string) *tar.Header {
+	h := *hdr
+	h.Name = name
+	if h.Typeflag == tar.TypeDir && name != "." {
+		h.Name += "/"
+	}
+	if h.Typeflag == tar.TypeRegA {
+		h.Typeflag = tar.TypeReg
+	}
+	if isSparse(hdr) {
+		h.Typeflag = tar.TypeReg
+		h.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			if !strings.HasPrefix(k, paxGNUSparse) {
+				h.PAXRecords[k] = v
+			}
+		}
+	}
+	if h.Typeflag == tar.TypeLink || h.Typeflag == tar.TypeSymlink || h.Typeflag == tar.TypeDir {
+		h.Size = 0
+	}
+	// Let archive/tar pick a format able to encode the header
+	h.Format = tar.FormatUnknown
+	return &h
+}
+
+// isChildPath returns whether the slash separated path p is inside dir.
+func isChildPath(dir, p string) bool {
+	if dir == "." {
+		return p != "."
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
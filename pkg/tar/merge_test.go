@@ -0,0 +1,101 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMergeTars(t *testing.T) {
+	base := []*testTarEntry{
+		{header: &tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{contents: "busybox", header: &tar.Header{Name: "bin/busybox", Size: 7, Mode: 0755}},
+		{header: &tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		{header: &tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		{header: &tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{contents: "a", header: &tar.Header{Name: "etc/a.conf", Size: 1, Mode: 0644}},
+		{contents: "b", header: &tar.Header{Name: "etc/b.conf", Size: 1, Mode: 0644}},
+		{header: &tar.Header{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{contents: "old", header: &tar.Header{Name: "var/cache/old", Size: 3, Mode: 0644}},
+		{header: &tar.Header{Name: "var/lib/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{contents: "db", header: &tar.Header{Name: "var/lib/db", Size: 2, Mode: 0644}},
+	}
+	overlay := []*testTarEntry{
+		// Removing the target of the hardlinks keeps them
+		{header: &tar.Header{Name: "bin/.wh.busybox"}},
+		{header: &tar.Header{Name: "etc/.wh.a.conf"}},
+		{contents: "B", header: &tar.Header{Name: "./etc/b.conf", Size: 1, Mode: 0600}},
+		// Only the contents of the lower layers are hidden
+		{contents: "new", header: &tar.Header{Name: "var/cache/new", Size: 3, Mode: 0644}},
+		{header: &tar.Header{Name: "var/cache/.wh..wh..opq"}},
+		// A file replacing a directory replaces its contents
+		{contents: "lib", header: &tar.Header{Name: "var/lib", Size: 3, Mode: 0644}},
+	}
+
+	var buf bytes.Buffer
+	err := MergeTars(&buf,
+		tar.NewReader(bytes.NewReader(readTestTar(t, base))),
+		tar.NewReader(bytes.NewReader(readTestTar(t, overlay))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := buf.Bytes()
+
+	hdrs, err := ListTar(tar.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+		mode     int64
+	}
+	var entries []entry
+	for _, hdr := range hdrs {
+		entries = append(entries, entry{hdr.Name, hdr.Typeflag, hdr.Linkname, hdr.Mode})
+	}
+	expected := []entry{
+		{"bin/", tar.TypeDir, "", 0755},
+		{"bin/ls", tar.TypeReg, "", 0755},
+		{"etc/", tar.TypeDir, "", 0755},
+		{"etc/b.conf", tar.TypeReg, "", 0600},
+		{"var/cache/", tar.TypeDir, "", 0755},
+		{"var/cache/new", tar.TypeReg, "", 0644},
+		{"var/lib", tar.TypeReg, "", 0644},
+		// Hardlinks come last
+		{"bin/sh", tar.TypeLink, "bin/ls", 0644},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries, wanted:\n%v\ngot:\n%v", expected, entries)
+	}
+
+	files, err := ExtractTarToMap(tar.NewReader(bytes.NewReader(data)), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := map[string][]byte{
+		"bin/ls":        []byte("busybox"),
+		"etc/b.conf":    []byte("B"),
+		"var/cache/new": []byte("new"),
+		"var/lib":       []byte("lib"),
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("unexpected files, wanted: %q, got: %q", expectedFiles, files)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !freebsd
+// +build !windows,!freebsd
+
+package tar
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// sysMknod calls mknod(2), whose device number is an int on this platform.
+func sysMknod(path string, mode uint32, dev uint64) error {
+	// syscall.Mknod takes an int, which is 32 bits wide on some platforms
+	if uint64(int(dev)) != dev || int(dev) < 0 {
+		return fmt.Errorf("device number %#x out of range", dev)
+	}
+	return syscall.Mknod(path, mode, int(dev))
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mergeGlobalRecords adds the PAX records of the global header hdr to global,
+// which is returned. Like with GNU tar, a record with an empty value deletes
+// the global record.
+func mergeGlobalRecords(global map[string]string, hdr *tar.Header) map[string]string {
+	if global == nil {
+		global = make(map[string]string, len(hdr.PAXRecords))
+	}
+	for key, value := range hdr.PAXRecords {
+		if value == "" {
+			delete(global, key)
+		} else {
+			global[key] = value
+		}
+	}
+	return global
+}
+
+// applyGlobalRecords returns a copy of hdr with the global PAX records that
+// aren't overridden by its own records. The path, linkpath and size records
+// are ignored, they can't apply to every entry.
+func applyGlobalRecords(hdr *tar.Header, global map[string]string) (*tar.Header, error) {
+	h := *hdr
+	h.PAXRecords = make(map[string]string, len(hdr.PAXRecords)+len(global))
+	for key, value := range hdr.PAXRecords {
+		h.PAXRecords[key] = value
+	}
+	for key, value := range global {
+		if _, ok := hdr.PAXRecords[key]; ok {
+			continue
+		}
+		var err error
+		switch key {
+		case "path", "linkpath", "size":
+			continue
+		case "uid":
+			h.Uid, err = strconv.Atoi(value)
+		case "gid":
+			h.Gid, err = strconv.Atoi(value)
+		case "uname":
+			h.Uname = value
+		case "gname":
+			h.Gname = value
+		case "mtime":
+			h.ModTime, err = parsePAXTime(value)
+		case "atime":
+			h.AccessTime, err = parsePAXTime(value)
+		case "ctime":
+			h.ChangeTime, err = parsePAXTime(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid global PAX record %q: %v", key, err)
+		}
+		h.PAXRecords[key] = value
+	}
+	return &h, nil
+}
+
+// parsePAXTime parses a PAX time record, a number of seconds since the epoch
+// with an optional fractional part.
+func parsePAXTime(s string) (time.Time, error) {
+	ss, sn := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		ss, sn = s[:i], s[i+1:]
+	}
+	secs, err := strconv.ParseInt(ss, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(sn) == 0 {
+		return time.Unix(secs, 0), nil
+	}
+	if strings.Trim(sn, "0123456789") != "" {
+		return time.Time{}, fmt.Errorf("invalid fractional part in %q", s)
+	}
+	// Keep the nanoseconds
+	if len(sn) > 9 {
+		sn = sn[:9]
+	}
+	sn += strings.Repeat("0", 9-len(sn))
+	nsecs, err := strconv.ParseInt(sn, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if strings.HasPrefix(ss, "-") {
+		return time.Unix(secs, -nsecs), nil
+	}
+	return time.Unix(secs, nsecs), nil
+}
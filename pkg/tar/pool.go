@@ -0,0 +1,154 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxBufferedSize is the limit on the total size of the regular files read
+// in memory for the workers of a concurrent extraction. The bigger files are
+// written by the goroutine reading the archive.
+const maxBufferedSize = 64 * 1024 * 1024
+
+// workerPool writes the regular files of a concurrent extraction.
+type workerPool struct {
+	jobs     chan poolJob
+	workers  sync.WaitGroup
+	inflight sync.WaitGroup
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// buffered is the size of the files read in memory and not written
+	// yet
+	buffered int64
+	// paths contains the paths of the files submitted since the last
+	// wait
+	paths map[string]struct{}
+	errs  []error
+}
+
+type poolJob struct {
+	fn   func() error
+	size int64
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{
+		jobs:  make(chan poolJob),
+		paths: make(map[string]struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		err := job.fn()
+		p.mu.Lock()
+		if err != nil {
+			p.errs = append(p.errs, err)
+		}
+		p.mu.Unlock()
+		p.release(job.size)
+		p.inflight.Done()
+	}
+}
+
+// reserve waits until size bytes can be read in memory for a file.
+func (p *workerPool) reserve(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buffered > 0 && p.buffered+size > maxBufferedSize {
+		p.cond.Wait()
+	}
+	p.buffered += size
+}
+
+// release frees the size bytes reserved for a file.
+func (p *workerPool) release(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buffered -= size
+	p.cond.Broadcast()
+}
+
+// submit makes a worker call fn to write the file at path, whose size bytes
+// have been reserved. It blocks until a worker is available.
+func (p *workerPool) submit(path string, size int64, fn func() error) {
+	p.mu.Lock()
+	p.paths[path] = struct{}{}
+	p.mu.Unlock()
+	p.inflight.Add(1)
+	p.jobs <- poolJob{fn: fn, size: size}
+}
+
+// pending returns whether path, one of its parents up to dir, or a path
+// inside it, is a file submitted since the last wait. A directory can't be
+// replaced while its files are written, they could be written through what
+// replaces it.
+func (p *workerPool) pending(path, dir string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dir = filepath.Clean(dir)
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for submitted := range p.paths {
+		if strings.HasPrefix(submitted, prefix) {
+			return true
+		}
+	}
+	for ; path != dir; path = filepath.Dir(path) {
+		if _, ok := p.paths[path]; ok {
+			return true
+		}
+		if path == filepath.Dir(path) {
+			break
+		}
+	}
+	return false
+}
+
+// failed returns whether a file couldn't be written since the last wait.
+func (p *workerPool) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.errs) > 0
+}
+
+// wait waits for the submitted files to be written, and returns the errors
+// of the ones that couldn't be.
+func (p *workerPool) wait() []error {
+	p.inflight.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errs := p.errs
+	p.errs = nil
+	p.paths = make(map[string]struct{})
+	return errs
+}
+
+// close waits for the submitted files to be written and stops the workers.
+func (p *workerPool) close() {
+	close(p.jobs)
+	p.workers.Wait()
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkerPoolPending(t *testing.T) {
+	p := newWorkerPool(2)
+	defer p.close()
+	dir := filepath.FromSlash("/dir")
+	release := make(chan struct{})
+	p.submit(filepath.FromSlash("/dir/a/file"), 0, func() error {
+		<-release
+		return nil
+	})
+	for _, tt := range []struct {
+		path    string
+		pending bool
+	}{
+		{"/dir/a/file", true},
+		// Creating an entry inside the file
+		{"/dir/a/file/sub", true},
+		// Replacing its directory
+		{"/dir/a", true},
+		{"/dir/a/other", false},
+		{"/dir/ab", false},
+		{"/dir/b", false},
+	} {
+		if pending := p.pending(filepath.FromSlash(tt.path), dir); pending != tt.pending {
+			t.Errorf("%s: expected pending to be %v, got %v", tt.path, tt.pending, pending)
+		}
+	}
+	close(release)
+	if errs := p.wait(); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if p.pending(filepath.FromSlash("/dir/a"), dir) {
+		t.Errorf("expected nothing to be pending after wait")
+	}
+}
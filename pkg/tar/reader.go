@@ -0,0 +1,104 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// errStaleReader is returned when reading the contents of an entry after the
+// Reader moved to the next one.
+var errStaleReader = errors.New("tar: read of an entry after the next one was requested")
+
+// Reader iterates over the entries of a tarball, like tar.Reader, validating
+// their paths and link targets.
+type Reader struct {
+	tr *tar.Reader
+	// body is the reader of the current entry
+	body *entryReader
+}
+
+// NewReader returns a Reader iterating over the entries read from tr.
+func NewReader(tr *tar.Reader) *Reader {
+	return &Reader{tr: tr}
+}
+
+// Next advances to the next entry of the tarball, and returns its header and
+// a reader of its contents. The reader is only valid until the next call to
+// Next. io.EOF is returned at the end of the tarball.
+//
+// The name of the returned header, and its link target for hardlinks, are
+// cleaned and relative to the root of the tarball. An InsecurePathError is
+// returned for an entry outside of the root of the tarball, and an
+// InsecureLinkError for a link pointing outside of it.
+func (r *Reader) Next() (*tar.Header, io.Reader, error) {
+	if r.body != nil {
+		r.body.stale = true
+		r.body = nil
+	}
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := *hdr
+	var ok bool
+	if h.Name, ok = cleanEntryPath(hdr.Name); !ok {
+		return nil, nil, &InsecurePathError{Name: hdr.Name, Dir: "."}
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		if h.Linkname, ok = cleanEntryPath(hdr.Linkname); !ok {
+			return nil, nil, &InsecureLinkError{Path: h.Name, Link: hdr.Linkname, Type: h.Typeflag}
+		}
+	case tar.TypeSymlink:
+		target := hdr.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(h.Name), target)
+		}
+		if _, ok := cleanEntryPath(target); !ok {
+			return nil, nil, &InsecureLinkError{Path: h.Name, Link: hdr.Linkname, Type: h.Typeflag}
+		}
+	}
+	r.body = &entryReader{r: r.tr}
+	return &h, r.body, nil
+}
+
+// cleanEntryPath returns the cleaned name, relative to the root of the
+// tarball, and whether it's inside it.
+func cleanEntryPath(name string) (string, bool) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// entryReader reads the contents of an entry until the Reader moves to the
+// next one.
+type entryReader struct {
+	r     io.Reader
+	stale bool
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+	if r.stale {
+		return 0, errStaleReader
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "./folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "/folder//bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "./folder/foo.txt",
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	sums := make(map[string]string)
+	var links []string
+	r := NewReader(tar.NewReader(bytes.NewReader(data)))
+	for {
+		hdr, body, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			if _, err := io.Copy(h, body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sums[hdr.Name] = fmt.Sprintf("%x", h.Sum(nil))
+		case tar.TypeLink:
+			links = append(links, hdr.Name+" -> "+hdr.Linkname)
+		}
+	}
+	expectedSums := map[string]string{
+		"folder/foo.txt": fmt.Sprintf("%x", sha256.Sum256([]byte("foo"))),
+		"folder/bar.txt": fmt.Sprintf("%x", sha256.Sum256([]byte("bar"))),
+	}
+	if !reflect.DeepEqual(sums, expectedSums) {
+		t.Errorf("unexpected sums, wanted: %v, got: %v", expectedSums, sums)
+	}
+	if expected := []string{"folder/link.txt -> folder/foo.txt"}; !reflect.DeepEqual(links, expected) {
+		t.Errorf("unexpected links, wanted: %v, got: %v", expected, links)
+	}
+}
+
+func TestReaderStaleBody(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	r := NewReader(tar.NewReader(bytes.NewReader(readTestTar(t, entries))))
+	_, body, err := r.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := r.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := body.Read(make([]byte, 3)); err != errStaleReader {
+		t.Errorf("expected errStaleReader, got: %v", err)
+	}
+}
+
+func TestReaderInsecurePaths(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Name: "../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "folder/../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		{Name: "folder/symlink", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+	} {
+		name := hdr.Name
+		data := readTestTar(t, []*testTarEntry{{header: hdr}})
+		_, _, err := NewReader(tar.NewReader(bytes.NewReader(data))).Next()
+		var pathErr *InsecurePathError
+		var linkErr *InsecureLinkError
+		if !errors.As(err, &pathErr) && !errors.As(err, &linkErr) {
+			t.Errorf("%q: expected an insecure path or link error, got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+)
+
+// paxGNUSparse is the prefix of the PAX records describing GNU sparse files.
+const paxGNUSparse = "GNU.sparse."
+
+// sparseBlockSize is the granularity at which holes are detected in sparse
+// files.
+const sparseBlockSize = 4096
+
+// isSparse returns whether hdr describes a GNU or PAX sparse file.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxGNUSparse) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies the size bytes of a sparse file from r to f.
+// archive/tar doesn't expose the sparse map and reads holes as zeros, so the
+// blocks only containing zeros are skipped over instead of being written,
+// leaving holes in f.
+func copySparse(f File, r io.Reader, size int64) error {
+	buf := make([]byte, sparseBlockSize)
+	var copied int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if copied != size {
+		return io.ErrUnexpectedEOF
+	}
+	// Set the size in case the file ends with a hole
+	return f.Truncate(size)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
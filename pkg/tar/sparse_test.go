@@ -0,0 +1,154 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// newSparseTestTar returns a tarball containing a single file in the GNU PAX
+// sparse format 1.0, with the given size and data fragments.
+func newSparseTestTar(t *testing.T, name string, size int64, fragments map[int64]string) []byte {
+	// archive/tar can't write sparse files, so the sparse map is written
+	// by hand in front of the data fragments
+	var sparseMap, data bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(fragments))
+	var offsets []int64
+	for offset := range fragments {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", offset, len(fragments[offset]))
+		data.WriteString(fragments[offset])
+	}
+	if n := sparseMap.Len() % 512; n != 0 {
+		sparseMap.Write(make([]byte, 512-n))
+	}
+
+	// archive/tar also drops the GNU.sparse.* records, so they are written
+	// with a placeholder prefix of the same length replaced afterwards
+	const placeholder = "RKT.sparse."
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:     filepath.Join(filepath.Dir(name), "GNUSparseFile.0", filepath.Base(name)),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		Size:     int64(sparseMap.Len() + data.Len()),
+		PAXRecords: map[string]string{
+			placeholder + "major":    "1",
+			placeholder + "minor":    "0",
+			placeholder + "name":     name,
+			placeholder + "realsize": fmt.Sprintf("%d", size),
+		},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := tw.Write(append(sparseMap.Bytes(), data.Bytes()...)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return bytes.Replace(buf.Bytes(), []byte(placeholder), []byte(paxGNUSparse), -1)
+}
+
+func TestExtractorSparse(t *testing.T) {
+	const size = 8 << 20
+	fragments := map[int64]string{
+		0:       "head",
+		4 << 20: strings.Repeat("x", 10000),
+	}
+	data := newSparseTestTar(t, "sparse.img", size, fragments)
+
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := NewExtractor().Extract(tar.NewReader(bytes.NewReader(data)), tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := filepath.Join(tmpdir, "sparse.img")
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contents) != size {
+		t.Fatalf("unexpected size, wanted: %d, got: %d", size, len(contents))
+	}
+	expected := make([]byte, size)
+	for offset, fragment := range fragments {
+		copy(expected[offset:], fragment)
+	}
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("unexpected contents")
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Allow for the filesystem allocating more than the data fragments,
+	// but not the whole file
+	if allocated := st.Blocks * 512; allocated >= size/2 {
+		t.Errorf("expected the holes not to be allocated, got %d bytes allocated for a %d bytes file", allocated, size)
+	}
+}
+
+func TestIndexSparse(t *testing.T) {
+	fragments := map[int64]string{
+		0:    "head",
+		8192: "tail",
+	}
+	data := newSparseTestTar(t, "sparse", 8196, fragments)
+	idx, err := BuildIndex(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rc, err := idx.Open("sparse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := make([]byte, 8196)
+	for offset, fragment := range fragments {
+		copy(want[offset:], fragment)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("wrong contents of the sparse file")
+	}
+}
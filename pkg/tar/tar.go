@@ -17,205 +17,413 @@ package tar
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
-
-	"github.com/appc/spec/pkg/device"
-	"github.com/coreos/rkt/pkg/fileutil"
-	"github.com/coreos/rkt/pkg/user"
+	"time"
 )
 
+// DEFAULT_DIR_MODE is the initial value of DefaultDirMode.
+//
+// Deprecated: use DefaultDirMode, or WithDefaultDirMode for a single
+// Extractor.
 const DEFAULT_DIR_MODE os.FileMode = 0755
 
+// DefaultDirMode is the mode of the parent directories created for the
+// entries without a directory entry of their own, unless set with
+// WithDefaultDirMode. It must be set before extracting.
+var DefaultDirMode = DEFAULT_DIR_MODE
+
 var ErrNotSupportedPlatform = errors.New("platform and architecture is not supported")
 
+// ErrSizeLimitExceeded is returned when reading files in memory would exceed
+// the given size limit.
+var ErrSizeLimitExceeded = errors.New("size limit exceeded")
+
 // Map of paths that should be whitelisted. The paths should be relative to the
 // root of the tar file and should be cleaned (for example using filepath.Clean)
 type PathWhitelistMap map[string]struct{}
 
 type FilePermissionsEditor func(string, int, int, byte, os.FileInfo) error
 
-func NewUidShiftingFilePermEditor(uidRange *user.UidRange) (FilePermissionsEditor, error) {
-	if os.Geteuid() != 0 {
-		return func(_ string, _, _ int, _ byte, _ os.FileInfo) error {
-			// The files are owned by the current user on creation.
-			// If we do nothing, they will remain so.
-			return nil
-		}, nil
+// symlinkDest returns the cleaned path a symlink at p, in the target
+// directory dir, points to. The relative linknames are resolved against the
+// directory containing p, and the absolute ones against dir, where the
+// extracted tree is rooted.
+func symlinkDest(dir, p, linkname string) string {
+	if filepath.IsAbs(linkname) {
+		return filepath.Clean(filepath.Join(dir, linkname))
 	}
+	return filepath.Clean(filepath.Join(filepath.Dir(p), linkname))
+}
 
-	return func(path string, uid, gid int, typ byte, fi os.FileInfo) error {
-		shiftedUid, shiftedGid, err := uidRange.ShiftRange(uint32(uid), uint32(gid))
-		if err != nil {
-			return err
-		}
-		if err := os.Lchown(path, int(shiftedUid), int(shiftedGid)); err != nil {
-			return err
-		}
-
-		// lchown(2) says that, depending on the linux kernel version, it
-		// can change the file's mode also if executed as root. So call
-		// os.Chmod after it.
-		if typ != tar.TypeSymlink {
-			if err := os.Chmod(path, fi.Mode()); err != nil {
-				return err
-			}
-		}
-		return nil
-	}, nil
+// isWithinDir returns whether the path p is dir or is inside dir.
+func isWithinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 // ExtractTarInsecure extracts a tarball (from a tar.Reader) into the target
 // directory. If pwl is not nil, only the paths in the map are extracted. If
-// overwrite is true, existing files will be overwritten.
+// overwrite is true, existing files will be overwritten, otherwise the
+// regular files are written over the existing regular files, keeping their
+// inode, and the other existing files fail the extraction. The existing
+// directories are merged with the ones of the tarball in both cases.
 func ExtractTarInsecure(tr *tar.Reader, target string, overwrite bool, pwl PathWhitelistMap, editor FilePermissionsEditor) error {
-	um := syscall.Umask(0)
-	defer syscall.Umask(um)
-
-	var dirhdrs []*tar.Header
-Tar:
-	for {
-		hdr, err := tr.Next()
-		switch err {
-		case io.EOF:
-			break Tar
-		case nil:
-			if pwl != nil {
-				relpath := filepath.Clean(hdr.Name)
-				if _, ok := pwl[relpath]; !ok {
-					continue
-				}
-			}
-			err = extractFile(tr, target, hdr, overwrite, editor)
-			if err != nil {
-				return fmt.Errorf("could not extract file %q in %q: %v", hdr.Name, target, err)
-			}
-			if hdr.Typeflag == tar.TypeDir {
-				dirhdrs = append(dirhdrs, hdr)
-			}
-		default:
-			return err
-		}
+	policy := overwriteInPlace
+	if overwrite {
+		policy = OverwriteReplace
 	}
+	e := NewExtractor(
+		WithOverwrite(policy),
+		WithWhitelist(pwl),
+		WithPermissionsEditor(editor),
+		WithPreserveTimes(),
+		WithUmask(0),
+	)
+	return e.Extract(tr, target)
+}
 
-	// Restore dirs atime and mtime. This has to be done after extracting
-	// as a file extraction will change its parent directory's times.
-	for _, hdr := range dirhdrs {
-		p := filepath.Join(target, hdr.Name)
-		if err := syscall.UtimesNano(p, HdrToTimespec(hdr)); err != nil {
-			return fmt.Errorf("UtimesNano failed on %q: %v", p, err)
-		}
-	}
-	return nil
+// ExtractTarContext extracts a tarball (from a tar.Reader) into dir in the
+// current process, with an Extractor configured with the given options only,
+// see ExtractReader. The extraction is aborted when ctx is done.
+func ExtractTarContext(ctx context.Context, tr *tar.Reader, dir string, opts ...Option) error {
+	return NewExtractor(opts...).ExtractContext(ctx, tr, dir)
 }
 
 // extractFile extracts the file described by hdr from the given tarball into
 // the target directory.
-// If overwrite is true, existing files will be overwritten.
-func extractFile(tr *tar.Reader, target string, hdr *tar.Header, overwrite bool, editor FilePermissionsEditor) error {
+// Existing files are handled according to x.overwrite.
+func (x *extraction) extractFile(tr io.Reader, target string, hdr *tar.Header) error {
+	if err := x.checkNames(hdr); err != nil {
+		return err
+	}
 	p := filepath.Join(target, hdr.Name)
+	if !isWithinDir(target, p) {
+		return &InsecurePathError{Name: hdr.Name, Dir: target}
+	}
 	fi := hdr.FileInfo()
 	typ := hdr.Typeflag
-	if overwrite {
-		info, err := os.Lstat(p)
-		switch {
-		case os.IsNotExist(err):
-		case err == nil:
-			// If the old and new paths are both dirs do nothing or
-			// RemoveAll will remove all dir's contents
-			if !info.IsDir() || typ != tar.TypeDir {
-				err := os.RemoveAll(p)
-				if err != nil {
+	switch typ {
+	case tar.TypeLink:
+		dest := filepath.Join(target, hdr.Linkname)
+		if !isWithinDir(target, dest) {
+			return &InsecureLinkError{Path: p, Link: hdr.Linkname, Type: typ}
+		}
+	case tar.TypeSymlink:
+		dest := symlinkDest(target, p, hdr.Linkname)
+		if !isWithinDir(target, dest) {
+			return &InsecureLinkError{Path: p, Link: hdr.Linkname, Type: typ}
+		}
+	}
+	switch typ {
+	case tar.TypeXGlobalHeader, tar.TypeXHeader:
+		// PAX headers are merged into the following entries' headers
+		// by archive/tar, there's nothing to extract
+		return nil
+	case tar.TypeGNULongName, tar.TypeGNULongLink:
+		// archive/tar merges these into the name and linkname of the
+		// following header. If one leaks through, discard its payload.
+		_, err := io.Copy(ioutil.Discard, tr)
+		return err
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeDir, tar.TypeLink,
+		tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		// Fail before touching anything, so the entry can be skipped
+		return &UnsupportedTypeError{Name: hdr.Name, Type: typ}
+	}
+	if (typ == tar.TypeChar || typ == tar.TypeBlock) && x.deviceNodes == DeviceNodesSkip {
+		return errSkipped
+	}
+	if typ == tar.TypeFifo && x.skipSpecial {
+		if x.skipSpecialStrict {
+			return &UnsupportedTypeError{Name: hdr.Name, Type: typ}
+		}
+		return errSkipped
+	}
+	if !specialFilesSupported && (typ == tar.TypeChar || typ == tar.TypeBlock || typ == tar.TypeFifo) {
+		return errSkipped
+	}
+	isReg := typ == tar.TypeReg || typ == tar.TypeRegA || typ == tar.TypeGNUSparse
+	if isReg && x.verify != nil {
+		if _, ok := x.verify[filepath.Clean(hdr.Name)]; !ok {
+			return &ChecksumMismatchError{Name: filepath.Clean(hdr.Name)}
+		}
+	}
+	info, err := x.fs.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+	case err == nil:
+		if x.skipUnchanged && isReg {
+			unchanged, err := x.unchanged(p, hdr, info)
+			if err != nil {
+				return err
+			}
+			if unchanged {
+				return errSkipped
+			}
+		}
+		if x.skipEmpty && isReg && hdr.Size == 0 && info.Mode().IsRegular() && info.Size() > 0 {
+			return errSkipped
+		}
+		// If the old and new paths are both dirs do nothing or
+		// RemoveAll will remove all dir's contents
+		if !info.IsDir() || typ != tar.TypeDir {
+			switch x.overwrite {
+			case OverwriteSkip:
+				return errSkipped
+			case OverwriteFail:
+				return fmt.Errorf("%q already exists", p)
+			case overwriteInPlace:
+				if !isReg || !info.Mode().IsRegular() {
+					return fmt.Errorf("%q already exists", p)
+				}
+			default:
+				if err := x.removeExisting(p, info, typ); err != nil {
 					return err
 				}
 			}
-		default:
-			return err
 		}
+	default:
+		return err
 	}
 
 	// Create parent dir if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(p), DEFAULT_DIR_MODE); err != nil {
+	if err := mkdirAll(x.fs, filepath.Dir(p), x.defaultDirMode()); err != nil {
 		return err
 	}
 	switch {
-	case typ == tar.TypeReg || typ == tar.TypeRegA:
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, fi.Mode())
-		if err != nil {
-			return err
+	case isReg:
+		var h, vh hash.Hash
+		if x.digest != nil {
+			h = x.digest()
+			tr = io.TeeReader(tr, h)
 		}
-		_, err = io.Copy(f, tr)
-		if err != nil {
-			f.Close()
-			return err
+		if x.verify != nil {
+			vh = x.verifyHash()
+			tr = io.TeeReader(tr, vh)
 		}
-		f.Close()
-	case typ == tar.TypeDir:
-		if err := os.MkdirAll(p, fi.Mode()); err != nil {
+		if x.skipFileData {
+			// Still read the contents for the digests
+			if h != nil || vh != nil {
+				if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+					return err
+				}
+			}
+			if err := x.writeFile(p, bytes.NewReader(nil), &tar.Header{Typeflag: tar.TypeReg}, fi, nil); err != nil {
+				return err
+			}
+		} else if x.pool != nil && !isSparse(hdr) && hdr.Size <= maxBufferedSize {
+			// Read the contents in memory, a worker writes them
+			x.pool.reserve(hdr.Size)
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				x.pool.release(hdr.Size)
+				return err
+			}
+			if h != nil {
+				x.sum = hex.EncodeToString(h.Sum(nil))
+			}
+			if vh != nil {
+				// Before writing anything
+				if err := x.verifySum(hdr, vh); err != nil {
+					x.pool.release(hdr.Size)
+					return err
+				}
+			}
+			x.pool.submit(p, hdr.Size, func() error {
+				err := x.writeFile(p, bytes.NewReader(data), hdr, fi, nil)
+				if err == nil {
+					err = x.finishEntry(p, hdr, fi)
+				}
+				if err != nil {
+					return fmt.Errorf("could not extract file %q in %q: %w", hdr.Name, x.dir, err)
+				}
+				return nil
+			})
+			return nil
+		} else if err := x.writeFile(p, tr, hdr, fi, x.copyBuffer()); err != nil {
 			return err
 		}
-		dir, err := os.Open(p)
-		if err != nil {
+		if h != nil {
+			x.sum = hex.EncodeToString(h.Sum(nil))
+		}
+		if vh != nil {
+			if err := x.verifySum(hdr, vh); err != nil {
+				return err
+			}
+		}
+	case typ == tar.TypeDir:
+		// Create the directory writable by its owner, so the entries
+		// inside it can be extracted. Its mode is restored once the
+		// extraction is finished. Both keep the special bits, like the
+		// sticky bit of /tmp, and also apply to a directory created
+		// earlier as a parent.
+		mode := fi.Mode() | 0700
+		if err := mkdirAll(x.fs, p, mode); err != nil {
 			return err
 		}
-		if err := dir.Chmod(fi.Mode()); err != nil {
-			dir.Close()
+		if err := x.fs.Chmod(p, mode); err != nil {
 			return err
 		}
-		dir.Close()
 	case typ == tar.TypeLink:
 		dest := filepath.Join(target, hdr.Linkname)
-		if err := os.Link(dest, p); err != nil {
-			return err
+		if err := x.fs.Link(dest, p); err != nil {
+			if !x.hardlinkFallback || !isCrossDeviceError(err) {
+				return err
+			}
+			x.log(LogNotices, "copying %q to %q: %v", dest, p, err)
+			if err := copyFile(dest, p); err != nil {
+				return err
+			}
 		}
 	case typ == tar.TypeSymlink:
-		if err := os.Symlink(hdr.Linkname, p); err != nil {
+		if err := x.fs.Symlink(hdr.Linkname, p); err != nil {
 			return err
 		}
-	case typ == tar.TypeChar:
-		dev := device.Makedev(uint(hdr.Devmajor), uint(hdr.Devminor))
-		mode := uint32(fi.Mode()) | syscall.S_IFCHR
-		if err := syscall.Mknod(p, mode, int(dev)); err != nil {
+	case (typ == tar.TypeChar || typ == tar.TypeBlock) && x.deviceNodes == DeviceNodesPlaceholder:
+		x.log(LogNotices, "creating a placeholder for device %q", p)
+		f, err := x.fs.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+		if err != nil {
 			return err
 		}
-	case typ == tar.TypeBlock:
-		dev := device.Makedev(uint(hdr.Devmajor), uint(hdr.Devminor))
-		mode := uint32(fi.Mode()) | syscall.S_IFBLK
-		if err := syscall.Mknod(p, mode, int(dev)); err != nil {
+		f.Close()
+	case typ == tar.TypeChar || typ == tar.TypeBlock || typ == tar.TypeFifo:
+		if err := x.mknod(p, hdr, fi); err != nil {
 			return err
 		}
-	case typ == tar.TypeFifo:
-		if err := syscall.Mkfifo(p, uint32(fi.Mode())); err != nil {
+	// TODO(jonboulle): implement other modes
+	default:
+		return &UnsupportedTypeError{Name: hdr.Name, Type: typ}
+	}
+	return x.finishEntry(p, hdr, fi)
+}
+
+// mknod creates the device node or fifo described by hdr at p. When an entry
+// appeared at p since it was checked, the overwrite policy applies to it, and
+// it is only removed, alone, if it isn't a directory.
+func (x *extraction) mknod(p string, hdr *tar.Header, fi os.FileInfo) error {
+	err := x.fs.Mknod(p, fi.Mode(), hdr.Devmajor, hdr.Devminor)
+	if !os.IsExist(err) {
+		return err
+	}
+	switch x.overwrite {
+	case OverwriteSkip:
+		return errSkipped
+	case OverwriteFail, overwriteInPlace:
+		return fmt.Errorf("%q already exists", p)
+	}
+	info, lerr := x.fs.Lstat(p)
+	if lerr != nil {
+		return lerr
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%q already exists and is a directory", p)
+	}
+	if err := x.fs.Remove(p); err != nil {
+		return err
+	}
+	return x.fs.Mknod(p, fi.Mode(), hdr.Devmajor, hdr.Devminor)
+}
+
+// removeExisting removes the entry described by info found at p, to replace
+// it with an entry of type typ. An existing symlink is unlinked without
+// following it. A directory is only removed with its contents when it's
+// replaced by a file or a hardlink, the symlinks, device nodes and fifos
+// replace it only if it's empty.
+func (x *extraction) removeExisting(p string, info os.FileInfo, typ byte) error {
+	switch typ {
+	case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return x.fs.Remove(p)
+	}
+	if info.IsDir() {
+		return x.fs.RemoveAll(p)
+	}
+	return x.fs.Remove(p)
+}
+
+// writeFile writes the regular file described by hdr at p, with the contents
+// read from r. They are copied through buf if it's not nil.
+func (x *extraction) writeFile(p string, r io.Reader, hdr *tar.Header, fi os.FileInfo, buf []byte) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if x.overwrite == OverwriteFail {
+		flags |= os.O_EXCL
+	}
+	f, err := x.fs.OpenFile(p, flags, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if x.fallocate && hdr.Size > 0 && !isSparse(hdr) {
+		if err := fallocate(f, hdr.Size); err != nil {
+			f.Close()
 			return err
 		}
-	case typ == tar.TypeXGlobalHeader:
-		return nil
-	// TODO(jonboulle): implement other modes
+	}
+	switch {
+	case isSparse(hdr):
+		err = copySparse(f, r, hdr.Size)
+	case buf != nil:
+		// Hide the ReadFrom method of the file, which would use its
+		// own buffer
+		_, err = io.CopyBuffer(struct{ io.Writer }{f}, r, buf)
 	default:
-		return fmt.Errorf("unsupported type: %v", typ)
+		_, err = io.Copy(f, r)
+	}
+	if err == nil && x.fsync == FsyncEach {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
 	}
+	f.Close()
+	// The mode given to open(2) goes through the process umask, and
+	// writing as an unprivileged user drops the setuid bit: set it
+	// explicitly once written
+	return x.fs.Chmod(p, x.mode(fi))
+}
 
-	if editor != nil {
-		if err := editor(p, hdr.Uid, hdr.Gid, hdr.Typeflag, fi); err != nil {
+// finishEntry sets the owner, extended attributes and times of the entry
+// created at p. The owner of the directories is set with their mode by
+// finishDirs.
+func (x *extraction) finishEntry(p string, hdr *tar.Header, fi os.FileInfo) error {
+	typ := hdr.Typeflag
+	if (x.chown || x.forceOwner) && typ != tar.TypeLink && typ != tar.TypeDir {
+		if err := x.lchown(p, hdr, fi); err != nil {
 			return err
 		}
 	}
 
-	// Restore entry atime and mtime.
-	// Use special function LUtimesNano not available on go's syscall package because we
-	// have to restore symlink's times and not the referenced file times.
-	ts := HdrToTimespec(hdr)
-	if hdr.Typeflag != tar.TypeSymlink {
-		if err := syscall.UtimesNano(p, ts); err != nil {
+	if x.editor != nil {
+		if err := x.editor(p, hdr.Uid, hdr.Gid, hdr.Typeflag, fi); err != nil {
 			return err
 		}
-	} else {
-		if err := fileutil.LUtimesNano(p, ts); err != nil && err != ErrNotSupportedPlatform {
+	}
+
+	if (x.xattrs || x.acls) && typ != tar.TypeLink {
+		if err := x.setXattrs(p, hdr); err != nil {
+			return err
+		}
+	}
+
+	if x.preserveTimes || x.fixedTimes {
+		// Restore entry atime and mtime, of the symlinks themselves
+		// and not of the referenced files.
+		atime, mtime := x.entryTimes(hdr)
+		if err := x.fs.Lchtimes(p, atime, mtime); err != nil {
 			return err
 		}
 	}
@@ -223,14 +431,61 @@ func extractFile(tr *tar.Reader, target string, hdr *tar.Header, overwrite bool,
 	return nil
 }
 
+// checkNames returns an InvalidNameError when the name or the link target of
+// hdr contains a NUL byte, or is an absolute path rejected by
+// x.absolutePaths. The other absolute paths are joined to the target
+// directory, which strips their leading slash.
+func (x *extraction) checkNames(hdr *tar.Header) error {
+	if strings.IndexByte(hdr.Name, 0) >= 0 {
+		return &InvalidNameError{Name: hdr.Name}
+	}
+	if strings.IndexByte(hdr.Linkname, 0) >= 0 {
+		return &InvalidNameError{Name: hdr.Linkname}
+	}
+	if x.absolutePaths != AbsolutePathsReject {
+		return nil
+	}
+	if strings.HasPrefix(hdr.Name, "/") {
+		return &InvalidNameError{Name: hdr.Name, Absolute: true}
+	}
+	// The absolute targets of symlinks are resolved when they're used
+	if hdr.Typeflag == tar.TypeLink && strings.HasPrefix(hdr.Linkname, "/") {
+		return &InvalidNameError{Name: hdr.Linkname, Absolute: true}
+	}
+	return nil
+}
+
+// maxFileFromTarSize is the limit on the size of the files read in memory by
+// extractFileFromTar.
+const maxFileFromTarSize = 64 * 1024 * 1024
+
 // extractFileFromTar extracts a regular file from the given tar, returning its
 // contents as a byte slice
 func extractFileFromTar(tr *tar.Reader, file string) ([]byte, error) {
+	return ExtractFileFromTarLimit(tr, file, maxFileFromTarSize)
+}
+
+// ExtractFileFromTarLimit extracts a regular file from the given tar,
+// returning its contents as a byte slice. If the file is bigger than max
+// bytes, ErrSizeLimitExceeded is returned.
+func ExtractFileFromTarLimit(tr *tar.Reader, file string, max int64) ([]byte, error) {
+	_, buf, err := extractFileFromTarWithHeader(tr, file, max)
+	return buf, err
+}
+
+// ExtractFileFromTarWithHeader extracts a regular file from the given tar,
+// returning its header and its contents as a byte slice. Files bigger than
+// 64MiB aren't read, ErrSizeLimitExceeded is returned instead.
+func ExtractFileFromTarWithHeader(tr *tar.Reader, file string) (*tar.Header, []byte, error) {
+	return extractFileFromTarWithHeader(tr, file, maxFileFromTarSize)
+}
+
+func extractFileFromTarWithHeader(tr *tar.Reader, file string, max int64) (*tar.Header, []byte, error) {
 	for {
 		hdr, err := tr.Next()
 		switch err {
 		case io.EOF:
-			return nil, fmt.Errorf("file not found")
+			return nil, nil, fmt.Errorf("file not found")
 		case nil:
 			if filepath.Clean(hdr.Name) != filepath.Clean(file) {
 				continue
@@ -239,19 +494,208 @@ func extractFileFromTar(tr *tar.Reader, file string) ([]byte, error) {
 			case tar.TypeReg:
 			case tar.TypeRegA:
 			default:
-				return nil, fmt.Errorf("requested file not a regular file")
+				return nil, nil, fmt.Errorf("requested file not a regular file")
 			}
-			buf, err := ioutil.ReadAll(tr)
+			// Read one more byte than allowed to detect files bigger
+			// than max, whatever the size in the header
+			buf, err := ioutil.ReadAll(io.LimitReader(tr, max+1))
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			return buf, nil
+			if int64(len(buf)) > max {
+				return nil, nil, ErrSizeLimitExceeded
+			}
+			return hdr, buf, nil
 		default:
+			return nil, nil, err
+		}
+	}
+}
+
+// ExtractFilesFromTar extracts the given regular files from the given tar in
+// a single pass, returning their contents keyed by the requested names. An
+// error listing the missing files is returned if some of them aren't in the
+// tar. Like with ExtractFileFromTarWithHeader, files bigger than 64MiB aren't
+// read.
+func ExtractFilesFromTar(tr *tar.Reader, files []string) (map[string][]byte, error) {
+	// requested maps the cleaned names to the requested ones
+	requested := make(map[string][]string, len(files))
+	for _, file := range files {
+		clean := filepath.Clean(file)
+		requested[clean] = append(requested[clean], file)
+	}
+	contents := make(map[string][]byte, len(files))
+	for len(requested) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return nil, err
 		}
+		clean := filepath.Clean(hdr.Name)
+		names, ok := requested[clean]
+		if !ok {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("requested file %q not a regular file", hdr.Name)
+		}
+		buf, err := ioutil.ReadAll(io.LimitReader(tr, maxFileFromTarSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+		}
+		if int64(len(buf)) > maxFileFromTarSize {
+			return nil, ErrSizeLimitExceeded
+		}
+		for _, name := range names {
+			contents[name] = buf
+		}
+		delete(requested, clean)
 	}
+	if len(requested) > 0 {
+		var missing []string
+		for _, names := range requested {
+			missing = append(missing, names...)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("files not found: %s", strings.Join(missing, ", "))
+	}
+	return contents, nil
 }
 
+// ExtractFileTo extracts the regular file named nameInTar from the given tar
+// to destPath, atomically replacing it if it exists: the file is written
+// with the mode of its entry to a temporary file in the same directory,
+// synced, and renamed to destPath. Readers of destPath see either the old
+// file or the complete new one.
+func ExtractFileTo(tr *tar.Reader, nameInTar, destPath string) error {
+	clean := filepath.Clean(nameInTar)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("file %q not found", nameInTar)
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Clean(hdr.Name) != clean {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		default:
+			return fmt.Errorf("requested file %q not a regular file", nameInTar)
+		}
+		return replaceFile(tr, hdr.FileInfo().Mode(), destPath)
+	}
+}
+
+// replaceFile atomically replaces the file at p with a file of the given
+// mode and with the contents read from r.
+func replaceFile(r io.Reader, mode os.FileMode, p string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("could not write file %q: %w", p, err)
+	}
+	// ioutil.TempFile creates the file with mode 0600
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// ListTar returns the headers of all the entries of the given tarball, in
+// archive order. The contents of the entries are read and discarded, so the
+// same read errors as an extraction are returned, but nothing is written to
+// disk.
+func ListTar(tr *tar.Reader) ([]*tar.Header, error) {
+	var hdrs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return hdrs, nil
+		case nil:
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+			}
+			hdrs = append(hdrs, hdr)
+		default:
+			return nil, err
+		}
+	}
+}
+
+// ExtractTarToMap reads the regular files of the given tarball in memory and
+// returns their contents keyed by their cleaned path. Other entries are
+// skipped. If the total size of the regular files is bigger than maxSize,
+// ErrSizeLimitExceeded is returned.
+func ExtractTarToMap(tr *tar.Reader, maxSize int64) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	remaining := maxSize
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return files, nil
+		case nil:
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			buf, err := ioutil.ReadAll(io.LimitReader(tr, remaining+1))
+			if err != nil {
+				return nil, fmt.Errorf("could not read file %q: %w", hdr.Name, err)
+			}
+			if int64(len(buf)) > remaining {
+				return nil, ErrSizeLimitExceeded
+			}
+			remaining -= int64(len(buf))
+			files[filepath.Clean(hdr.Name)] = buf
+		default:
+			return nil, err
+		}
+	}
+}
+
+// HdrToTimespec returns the atime and mtime recorded in hdr. Archives often
+// don't record an access time, in that case the modification time is used.
 func HdrToTimespec(hdr *tar.Header) []syscall.Timespec {
-	return []syscall.Timespec{fileutil.TimeToTimespec(hdr.AccessTime), fileutil.TimeToTimespec(hdr.ModTime)}
+	atime, mtime := hdrTimes(hdr)
+	return []syscall.Timespec{timeToTimespec(atime), timeToTimespec(mtime)}
+}
+
+// hdrTimes returns the access and modification times of hdr, like
+// HdrToTimespec.
+func hdrTimes(hdr *tar.Header) (time.Time, time.Time) {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return atime, hdr.ModTime
+}
+
+// timeToTimespec converts t to a syscall.Timespec, with the zero time
+// converted to the Unix epoch like fileutil.TimeToTimespec does.
+func timeToTimespec(t time.Time) syscall.Timespec {
+	var nsec int64
+	if !t.IsZero() {
+		nsec = t.UnixNano()
+	}
+	return syscall.NsecToTimespec(nsec)
 }
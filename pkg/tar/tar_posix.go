@@ -0,0 +1,152 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+	"github.com/coreos/rkt/pkg/user"
+)
+
+func NewUidShiftingFilePermEditor(uidRange *user.UidRange) (FilePermissionsEditor, error) {
+	if os.Geteuid() != 0 {
+		return func(_ string, _, _ int, _ byte, _ os.FileInfo) error {
+			// The files are owned by the current user on creation.
+			// If we do nothing, they will remain so.
+			return nil
+		}, nil
+	}
+
+	return func(path string, uid, gid int, typ byte, fi os.FileInfo) error {
+		shiftedUid, shiftedGid, err := uidRange.ShiftRange(uint32(uid), uint32(gid))
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, int(shiftedUid), int(shiftedGid)); err != nil {
+			return err
+		}
+
+		// lchown(2) says that, depending on the linux kernel version, it
+		// can change the file's mode also if executed as root. So call
+		// os.Chmod after it.
+		if typ != tar.TypeSymlink {
+			if err := os.Chmod(path, fi.Mode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// specialFilesSupported is whether device nodes and fifos can be created on
+// this platform.
+const specialFilesSupported = true
+
+// mknod creates at p the device node with the given mode and device number.
+func mknod(p string, mode os.FileMode, major, minor int64) error {
+	dev, err := mkdev(major, minor)
+	if err != nil {
+		return err
+	}
+	m := uint32(mode.Perm())
+	if mode&os.ModeCharDevice != 0 {
+		m |= syscall.S_IFCHR
+	} else {
+		m |= syscall.S_IFBLK
+	}
+	return sysMknod(p, m, dev)
+}
+
+// mkdev returns the device number major:minor in the encoding of the
+// platform.
+func mkdev(major, minor int64) (uint64, error) {
+	if major < 0 || minor < 0 {
+		return 0, fmt.Errorf("invalid device number %d:%d", major, minor)
+	}
+	makedev := platformMakedev()
+	if makedev == nil {
+		return 0, ErrNotSupportedPlatform
+	}
+	dev, ok := makedev(uint64(major), uint64(minor))
+	if !ok {
+		return 0, fmt.Errorf("device number %d:%d out of range", major, minor)
+	}
+	return dev, nil
+}
+
+// mkfifo creates a fifo at p.
+func mkfifo(p string, mode os.FileMode) error {
+	if err := syscall.Mkfifo(p, uint32(mode.Perm())); err != nil {
+		if err == syscall.EPERM {
+			return fmt.Errorf("not permitted to create fifo %q: %v", p, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// setProcessUmask sets the umask of the process and returns the previous
+// one.
+func setProcessUmask(mask int) int {
+	return syscall.Umask(mask)
+}
+
+func lsetxattr(p, name string, value []byte) error {
+	return fileutil.Lsetxattr(p, name, value, 0)
+}
+
+func lutimesNano(p string, ts []syscall.Timespec) error {
+	return fileutil.LUtimesNano(p, ts)
+}
+
+// fileInode returns the inode of the file described by info, if it has
+// several links.
+func fileInode(info os.FileInfo) (inode, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// fileOwner returns the uid and gid of the file described by info.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileDevice returns the device of the file described by info.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// syncFilesystems flushes the filesystem caches to disk.
+func syncFilesystems() {
+	syscall.Sync()
+}
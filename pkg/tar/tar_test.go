@@ -12,16 +12,22 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build linux
+// +build linux
+
 package tar
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -35,138 +41,6 @@ func init() {
 	multicall.MaybeExec()
 }
 
-type testTarEntry struct {
-	header   *tar.Header
-	contents string
-}
-
-func newTestTar(entries []*testTarEntry) (string, error) {
-	t, err := ioutil.TempFile("", "test-tar")
-	if err != nil {
-		return "", err
-	}
-	defer t.Close()
-	tw := tar.NewWriter(t)
-	for _, entry := range entries {
-		// Add default mode
-		if entry.header.Mode == 0 {
-			if entry.header.Typeflag == tar.TypeDir {
-				entry.header.Mode = 0755
-			} else {
-				entry.header.Mode = 0644
-			}
-		}
-		// Add calling user uid and gid or tests will fail
-		entry.header.Uid = os.Getuid()
-		entry.header.Gid = os.Getgid()
-		if err := tw.WriteHeader(entry.header); err != nil {
-			return "", err
-		}
-		if _, err := io.WriteString(tw, entry.contents); err != nil {
-			return "", err
-		}
-	}
-	if err := tw.Close(); err != nil {
-		return "", err
-	}
-	return t.Name(), nil
-}
-
-type fileInfo struct {
-	path     string
-	typeflag byte
-	size     int64
-	contents string
-	mode     os.FileMode
-}
-
-func fileInfoSliceToMap(slice []*fileInfo) map[string]*fileInfo {
-	fim := make(map[string]*fileInfo, len(slice))
-	for _, fi := range slice {
-		fim[fi.path] = fi
-	}
-	return fim
-}
-
-func checkExpectedFiles(dir string, expectedFiles map[string]*fileInfo) error {
-	files := make(map[string]*fileInfo)
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		fm := info.Mode()
-		if path == dir {
-			return nil
-		}
-		relpath, err := filepath.Rel(dir, path)
-		if err != nil {
-			return err
-		}
-		switch {
-		case fm.IsRegular():
-			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeReg, size: info.Size(), mode: info.Mode().Perm()}
-		case info.IsDir():
-			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeDir, mode: info.Mode().Perm()}
-		case fm&os.ModeSymlink != 0:
-			files[relpath] = &fileInfo{path: relpath, typeflag: tar.TypeSymlink, mode: info.Mode()}
-		default:
-			return fmt.Errorf("file mode not handled: %v", fm)
-		}
-
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	// Set defaults for not specified expected file mode
-	for _, ef := range expectedFiles {
-		if ef.mode == 0 {
-			if ef.typeflag == tar.TypeDir {
-				ef.mode = 0755
-			} else {
-				ef.mode = 0644
-			}
-		}
-	}
-
-	for _, ef := range expectedFiles {
-		_, ok := files[ef.path]
-		if !ok {
-			return fmt.Errorf("Expected file %q not in files", ef.path)
-		}
-
-	}
-
-	for _, file := range files {
-		ef, ok := expectedFiles[file.path]
-		if !ok {
-			return fmt.Errorf("file %q not in expectedFiles", file.path)
-		}
-		if ef.typeflag != file.typeflag {
-			return fmt.Errorf("file %q: file type differs: wanted: %d, got: %d", file.path, ef.typeflag, file.typeflag)
-		}
-		if ef.typeflag == tar.TypeReg {
-			if ef.size != file.size {
-				return fmt.Errorf("file %q: size differs: wanted %d, wanted: %d", file.path, ef.size, file.size)
-			}
-			if ef.contents != "" {
-				buf, err := ioutil.ReadFile(filepath.Join(dir, file.path))
-				if err != nil {
-					return fmt.Errorf("unexpected error: %v", err)
-				}
-				if string(buf) != ef.contents {
-					return fmt.Errorf("unexpected contents, wanted: %s, got: %s", ef.contents, buf)
-				}
-
-			}
-		}
-		// Check modes but ignore symlinks
-		if ef.mode != file.mode && ef.typeflag != tar.TypeSymlink {
-			return fmt.Errorf("file %q: mode differs: wanted %#o, got: %#o", file.path, ef.mode, file.mode)
-		}
-
-	}
-	return nil
-}
-
 func TestExtractTarFolders(t *testing.T) {
 	if !sys.HasChrootCapability() {
 		t.Skipf("chroot capability not available. Disabling test.")
@@ -352,6 +226,334 @@ func TestExtractTarFileToBuf(t *testing.T) {
 	}
 }
 
+func TestExtractFileFromTarLimit(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: strings.Repeat("a", 1000),
+			header: &tar.Header{
+				Name: "huge.txt",
+				Size: 1000,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	buf, err := ExtractFileFromTarLimit(tar.NewReader(bytes.NewReader(data)), "foo.txt", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+
+	buf, err = ExtractFileFromTarLimit(tar.NewReader(bytes.NewReader(data)), "huge.txt", 999)
+	if err != ErrSizeLimitExceeded {
+		t.Errorf("expected ErrSizeLimitExceeded, got: %v", err)
+	}
+	if buf != nil {
+		t.Errorf("expected no contents, got %d bytes", len(buf))
+	}
+}
+
+func TestExtractFileFromTarWithHeader(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.sh",
+				Size: 3,
+				Mode: int64(0755),
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	hdr, buf, err := ExtractFileFromTarWithHeader(tar.NewReader(bytes.NewReader(data)), "folder/foo.sh")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+	if hdr.Name != "folder/foo.sh" {
+		t.Errorf("unexpected name, wanted: %s, got: %s", "folder/foo.sh", hdr.Name)
+	}
+	if hdr.Mode != 0755 {
+		t.Errorf("unexpected mode, wanted: %#o, got: %#o", 0755, hdr.Mode)
+	}
+
+	if _, _, err := ExtractFileFromTarWithHeader(tar.NewReader(bytes.NewReader(data)), "folder/"); err == nil {
+		t.Errorf("expected an error for a directory")
+	}
+}
+
+func TestExtractFilesFromTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "manifest",
+			header: &tar.Header{
+				Name: "manifest",
+				Size: 8,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "rootfs/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "signature",
+			header: &tar.Header{
+				Name: "signature",
+				Size: 9,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	files, err := ExtractFilesFromTar(tar.NewReader(bytes.NewReader(data)), []string{"manifest", "./signature"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string][]byte{
+		"manifest":    []byte("manifest"),
+		"./signature": []byte("signature"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files, wanted: %q, got: %q", expected, files)
+	}
+
+	_, err = ExtractFilesFromTar(tar.NewReader(bytes.NewReader(data)), []string{"manifest", "missing", "signature"})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected the error to report the missing file, got: %v", err)
+	}
+}
+
+func TestExtractFileTo(t *testing.T) {
+	contents := strings.Repeat("new", 1<<20)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "etc/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "etc/app.conf",
+				Size: int64(len(contents)),
+				Mode: 0640,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dest := filepath.Join(tmpdir, "app.conf")
+	if err := ioutil.WriteFile(dest, []byte("old"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Read the file while it's replaced, it's never seen partially
+	// written
+	done := make(chan struct{})
+	partial := make(chan string, 1)
+	go func() {
+		defer close(partial)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			buf, err := ioutil.ReadFile(dest)
+			if err != nil {
+				partial <- err.Error()
+				return
+			}
+			if s := string(buf); s != "old" && s != contents {
+				partial <- fmt.Sprintf("%d bytes", len(s))
+				return
+			}
+		}
+	}()
+	err = ExtractFileTo(tar.NewReader(bytes.NewReader(data)), "./etc/app.conf", dest)
+	close(done)
+	if s, ok := <-partial; ok {
+		t.Errorf("unexpected read of the destination: %s", s)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "app.conf", typeflag: tar.TypeReg, size: int64(len(contents)), mode: 0640, contents: contents},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := ExtractFileTo(tar.NewReader(bytes.NewReader(data)), "etc", dest); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("expected an error for a directory, got: %v", err)
+	}
+	if err := ExtractFileTo(tar.NewReader(bytes.NewReader(data)), "missing", dest); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	// Nothing is left behind by the failures
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestListTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:     "folder/foo.txt",
+				Typeflag: tar.TypeReg,
+				Size:     3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name:     "bar.txt",
+				Typeflag: tar.TypeReg,
+				Size:     3,
+			},
+		},
+	}
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+
+	hdrs, err := ListTar(tar.NewReader(containerTar))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hdrs) != len(entries) {
+		t.Fatalf("unexpected number of headers, wanted: %d, got: %d", len(entries), len(hdrs))
+	}
+	for i, hdr := range hdrs {
+		if hdr.Name != entries[i].header.Name || hdr.Typeflag != entries[i].header.Typeflag {
+			t.Errorf("unexpected header %d, wanted: %q (%c), got: %q (%c)", i, entries[i].header.Name, entries[i].header.Typeflag, hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// A tarball truncated in the middle of foo.txt returns an error
+	data, err := ioutil.ReadFile(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ListTar(tar.NewReader(bytes.NewReader(data[:1024+1]))); err == nil {
+		t.Errorf("expected an error listing a truncated tarball")
+	}
+}
+
+func TestExtractTarToMap(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			contents: "barbaz",
+			header: &tar.Header{
+				Name: "./bar.txt",
+				Size: 6,
+			},
+		},
+	}
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	data, err := ioutil.ReadFile(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files, err := ExtractTarToMap(tar.NewReader(bytes.NewReader(data)), 9)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"folder/foo.txt": "foo",
+		"bar.txt":        "barbaz",
+	}
+	if len(files) != len(expected) {
+		t.Errorf("unexpected files: %v", files)
+	}
+	for name, contents := range expected {
+		if string(files[name]) != contents {
+			t.Errorf("%s: unexpected contents, wanted: %s, got: %s", name, contents, files[name])
+		}
+	}
+
+	if _, err := ExtractTarToMap(tar.NewReader(bytes.NewReader(data)), 8); err != ErrSizeLimitExceeded {
+		t.Errorf("expected ErrSizeLimitExceeded, got: %v", err)
+	}
+}
+
 func TestExtractTarPWL(t *testing.T) {
 	if !sys.HasChrootCapability() {
 		t.Skipf("chroot capability not available. Disabling test.")
@@ -432,6 +634,96 @@ func TestExtractTarOverwrite(t *testing.T) {
 func TestExtractTarOverwriteInsecure(t *testing.T) {
 	testExtractTarOverwrite(t, extractTarInsecureHelper)
 }
+
+func TestExtractTarInsecureNoOverwrite(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Mkdir(filepath.Join(tmpdir, "folder"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "hello.txt"), []byte("old hello"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Link(filepath.Join(tmpdir, "hello.txt"), filepath.Join(tmpdir, "link.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(tmpdir, "symlink")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extract := func(entries []*testTarEntry) error {
+		return ExtractTarInsecure(tar.NewReader(bytes.NewReader(readTestTar(t, entries))), tmpdir, false, nil, nil)
+	}
+
+	// The existing directories are merged
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	if err := extract(entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An existing regular file is written over in place, its other
+	// links see the new contents
+	entries = []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+			},
+		},
+	}
+	if err := extract(entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The other existing files are a conflict, and aren't modified
+	for _, entry := range []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "hello.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			contents: "evil",
+			header: &tar.Header{
+				Name: "symlink",
+				Size: 4,
+			},
+		},
+	} {
+		if err := extract([]*testTarEntry{entry}); err == nil {
+			t.Errorf("%s: expected an error for the existing file", entry.header.Name)
+		}
+	}
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir},
+		{path: "folder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "hello.txt", typeflag: tar.TypeReg, size: 5, contents: "hello"},
+		{path: "link.txt", typeflag: tar.TypeReg, size: 5, contents: "hello"},
+		{path: "symlink", typeflag: tar.TypeSymlink},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
 func testExtractTarOverwrite(t *testing.T, extractTar func(io.Reader, string) error) {
 	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
 	if err != nil {
@@ -787,6 +1079,256 @@ func testExtractTarHardLink(t *testing.T, extractTar func(io.Reader, string) err
 	}
 }
 
+func TestExtractTarHardLinkBeforeTarget(t *testing.T) {
+	if !sys.HasChrootCapability() {
+		t.Skipf("chroot capability not available. Disabling test.")
+	}
+	testExtractTarHardLinkBeforeTarget(t, extractTarHelper)
+}
+func TestExtractTarHardLinkBeforeTargetInsecure(t *testing.T) {
+	testExtractTarHardLinkBeforeTarget(t, extractTarInsecureHelper)
+}
+func testExtractTarHardLinkBeforeTarget(t *testing.T, extractTar func(io.Reader, string) error) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "links/foolink",
+				Typeflag: tar.TypeLink,
+				Linkname: "files/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "files/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0555),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "files/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer os.Chmod(filepath.Join(tmpdir, "files"), 0755)
+	if err := extractTar(containerTar, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var origFile syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(tmpdir, "files/foo.txt"), &origFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var linkedFile syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(tmpdir, "links/foolink"), &linkedFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if origFile.Ino != linkedFile.Ino {
+		t.Errorf("original file and linked file have different inodes")
+	}
+}
+
+func TestExtractTarFifo(t *testing.T) {
+	if !sys.HasChrootCapability() {
+		t.Skipf("chroot capability not available. Disabling test.")
+	}
+	testExtractTarFifo(t, extractTarHelper)
+}
+func TestExtractTarFifoInsecure(t *testing.T) {
+	testExtractTarFifo(t, extractTarInsecureHelper)
+}
+func testExtractTarFifo(t *testing.T, extractTar func(io.Reader, string) error) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "run/fifo",
+				Typeflag: tar.TypeFifo,
+				Mode:     int64(0600),
+			},
+		},
+	}
+
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := extractTar(containerTar, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(tmpdir, "run/fifo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("expected a named pipe, got mode: %s", info.Mode())
+	}
+	if info.Mode().Perm() != os.FileMode(0600) {
+		t.Errorf("unexpected fifo mode: %s", info.Mode())
+	}
+}
+
+func TestExtractTarReadOnlyDir(t *testing.T) {
+	if !sys.HasChrootCapability() {
+		t.Skipf("chroot capability not available. Disabling test.")
+	}
+	testExtractTarReadOnlyDir(t, extractTarHelper)
+}
+func TestExtractTarReadOnlyDirInsecure(t *testing.T) {
+	testExtractTarReadOnlyDir(t, extractTarInsecureHelper)
+}
+func testExtractTarReadOnlyDir(t *testing.T, extractTar func(io.Reader, string) error) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0555),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/subfolder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0500),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/subfolder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer os.Chmod(filepath.Join(tmpdir, "folder/subfolder"), 0755)
+	defer os.Chmod(filepath.Join(tmpdir, "folder"), 0755)
+	if err := extractTar(containerTar, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFiles := []*fileInfo{
+		{path: "folder", typeflag: tar.TypeDir, mode: 0555},
+		{path: "folder/subfolder", typeflag: tar.TypeDir, mode: 0500},
+		{path: "folder/subfolder/foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarGNULongNames(t *testing.T) {
+	if !sys.HasChrootCapability() {
+		t.Skipf("chroot capability not available. Disabling test.")
+	}
+	testExtractTarGNULongNames(t, extractTarHelper)
+}
+func TestExtractTarGNULongNamesInsecure(t *testing.T) {
+	testExtractTarGNULongNames(t, extractTarInsecureHelper)
+}
+func testExtractTarGNULongNames(t *testing.T, extractTar func(io.Reader, string) error) {
+	// Names longer than 100 bytes are stored in TypeGNULongName and
+	// TypeGNULongLink entries in the GNU format
+	longName := strings.Repeat("d", 60) + "/" + strings.Repeat("f", 60)
+	longLink := strings.Repeat("l", 120)
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:   longName,
+				Size:   3,
+				Format: tar.FormatGNU,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: longLink,
+				Format:   tar.FormatGNU,
+			},
+		},
+	}
+
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(testTarPath)
+	containerTar, err := os.Open(testTarPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer containerTar.Close()
+	tmpdir, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := extractTar(containerTar, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFiles := []*fileInfo{
+		{path: filepath.Dir(longName), typeflag: tar.TypeDir},
+		{path: longName, typeflag: tar.TypeReg, size: 3, contents: "foo"},
+		{path: "symlink", typeflag: tar.TypeSymlink},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	link, err := os.Readlink(filepath.Join(tmpdir, "symlink"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link != longLink {
+		t.Errorf("unexpected symlink target, wanted: %s, got: %s", longLink, link)
+	}
+}
+
 func extractTarOverwriteHelper(rdr io.Reader, target string) error {
 	return ExtractTar(rdr, target, true, user.NewBlankUidRange(), nil)
 }
@@ -0,0 +1,70 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// specialFilesSupported is whether device nodes and fifos can be created on
+// this platform. On Windows the device and fifo entries are skipped.
+const specialFilesSupported = false
+
+func mknod(p string, mode os.FileMode, major, minor int64) error {
+	return ErrNotSupportedPlatform
+}
+
+func mkfifo(p string, mode os.FileMode) error {
+	return ErrNotSupportedPlatform
+}
+
+// setProcessUmask does nothing, Windows has no umask.
+func setProcessUmask(mask int) int {
+	return 0
+}
+
+func lsetxattr(p, name string, value []byte) error {
+	return ErrNotSupportedPlatform
+}
+
+func lutimesNano(p string, ts []syscall.Timespec) error {
+	return ErrNotSupportedPlatform
+}
+
+// fileInode returns false, hardlinks aren't detected on Windows.
+func fileInode(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+// fileOwner returns false, files have no uid and gid on Windows.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// fileDevice returns false, devices aren't detected on Windows.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// syncFilesystems does nothing, Windows can only flush files one by one.
+func syncFilesystems() {
+}
+
+// extractChroot returns ErrNotSupportedPlatform, Windows has no chroot.
+func (e *Extractor) extractChroot(ctx context.Context, next nextTarball, dir string) error {
+	return ErrNotSupportedPlatform
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestWindowsInMemory(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	data := readTestTar(t, entries)
+
+	hdrs, err := ListTar(tar.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hdrs) != 2 {
+		t.Errorf("unexpected number of entries, wanted: 2, got: %d", len(hdrs))
+	}
+	buf, err := extractFileFromTar(tar.NewReader(bytes.NewReader(data)), "folder/foo.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+}
+
+func TestWindowsSkipsSpecialFiles(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "null",
+				Typeflag: tar.TypeChar,
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "fifo",
+				Typeflag: tar.TypeFifo,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir, err := extractEntries(t, NewExtractor(), entries)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedFiles := []*fileInfo{
+		{path: "foo.txt", typeflag: tar.TypeReg, size: 3, contents: "foo", mode: 0666},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// validateDir is the directory the tarballs are extracted into by
+// ValidateTar.
+const validateDir = "/validate"
+
+// ValidateTar reads the whole tarball from tr and returns the first problem
+// an extraction with the default options would find, like an entry or a link
+// pointing outside of the target directory, an unsupported entry type, or a
+// truncated archive. Nothing is written: the extraction is a dry run into an
+// empty directory, see WithDryRun.
+func ValidateTar(tr *tar.Reader) error {
+	return NewExtractor(WithFS(emptyFS{}), WithDryRun()).Extract(tr, validateDir)
+}
+
+// emptyFS is an FS with an empty root directory, which can't be modified.
+// It's meant to be the base of a dryRunFS.
+type emptyFS struct{}
+
+func emptyFSError(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (emptyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return nil, emptyFSError("open", name)
+}
+
+func (emptyFS) Mkdir(name string, perm os.FileMode) error {
+	return emptyFSError("mkdir", name)
+}
+
+func (emptyFS) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+func (emptyFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+func (emptyFS) Chmod(name string, mode os.FileMode) error {
+	return emptyFSError("chmod", name)
+}
+
+func (emptyFS) Lchown(name string, uid, gid int) error {
+	return emptyFSError("lchown", name)
+}
+
+func (emptyFS) Lchtimes(name string, atime, mtime time.Time) error {
+	return emptyFSError("lchtimes", name)
+}
+
+func (emptyFS) Mknod(name string, mode os.FileMode, major, minor int64) error {
+	return emptyFSError("mknod", name)
+}
+
+func (emptyFS) Lstat(name string) (os.FileInfo, error) {
+	if name == filepath.Dir(name) {
+		return &dryRunInfo{name: name, mode: os.ModeDir | 0755}, nil
+	}
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+}
+
+func (emptyFS) Remove(name string) error {
+	return emptyFSError("remove", name)
+}
+
+func (emptyFS) RemoveAll(name string) error {
+	return emptyFSError("removeall", name)
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestValidateTar(t *testing.T) {
+	clean := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/fifo",
+				Typeflag: tar.TypeFifo,
+			},
+		},
+	}
+	data := readTestTar(t, clean)
+	if err := ValidateTar(tar.NewReader(bytes.NewReader(data))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(validateDir); !os.IsNotExist(err) {
+		t.Errorf("the validation touched the OS filesystem: %v", err)
+	}
+
+	// target is an entry extracted before each invalid one
+	target := &testTarEntry{
+		contents: "foo",
+		header: &tar.Header{
+			Name: "foo.txt",
+			Size: 3,
+		},
+	}
+	tests := []struct {
+		name  string
+		entry *testTarEntry
+		check func(err error) bool
+	}{
+		{
+			"path outside",
+			&testTarEntry{header: &tar.Header{Name: "../escape.txt"}},
+			func(err error) bool {
+				var ipe *InsecurePathError
+				return errors.As(err, &ipe)
+			},
+		},
+		{
+			"symlink outside",
+			&testTarEntry{header: &tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}},
+			func(err error) bool {
+				var ile *InsecureLinkError
+				return errors.As(err, &ile) && ile.Type == tar.TypeSymlink
+			},
+		},
+		{
+			"hardlink outside",
+			&testTarEntry{header: &tar.Header{Name: "shadow", Typeflag: tar.TypeLink, Linkname: "../etc/shadow"}},
+			func(err error) bool {
+				var ile *InsecureLinkError
+				return errors.As(err, &ile) && ile.Type == tar.TypeLink
+			},
+		},
+		{
+			"unsupported type",
+			&testTarEntry{header: &tar.Header{Name: "contiguous", Typeflag: tar.TypeCont}},
+			func(err error) bool {
+				var ute *UnsupportedTypeError
+				return errors.As(err, &ute)
+			},
+		},
+	}
+	for _, tt := range tests {
+		data := readTestTar(t, []*testTarEntry{target, tt.entry})
+		if err := ValidateTar(tar.NewReader(bytes.NewReader(data))); !tt.check(err) {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+
+	// In the middle of the contents of foo.txt
+	truncated := readTestTar(t, []*testTarEntry{target})[:blockSize+2]
+	var tae *TruncatedArchiveError
+	if err := ValidateTar(tar.NewReader(bytes.NewReader(truncated))); !errors.As(err, &tae) {
+		t.Errorf("expected a TruncatedArchiveError, got: %v", err)
+	} else if tae.Name != "foo.txt" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
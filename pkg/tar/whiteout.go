@@ -0,0 +1,163 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix is the prefix of the AUFS whiteout markers. A
+	// .wh.<name> entry marks <name> as deleted in a layer.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque is the AUFS marker of an opaque directory, whose
+	// contents from lower layers are hidden.
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// overlayOpaqueXattr is the extended attribute marking an opaque
+	// directory in overlayfs layers.
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// isWhiteout returns whether hdr is an AUFS whiteout marker.
+func isWhiteout(hdr *tar.Header) bool {
+	return strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix)
+}
+
+// isOpaqueDir returns whether hdr is a directory marked as opaque with the
+// overlayfs extended attribute.
+func isOpaqueDir(hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeDir {
+		return false
+	}
+	return hdr.Xattrs[overlayOpaqueXattr] == "y" || hdr.PAXRecords[paxSchilyXattr+overlayOpaqueXattr] == "y"
+}
+
+// withoutOpaqueXattr returns a copy of hdr without the overlayfs opaque
+// extended attribute, which has no meaning once the layer is applied.
+func withoutOpaqueXattr(hdr *tar.Header) *tar.Header {
+	h := *hdr
+	h.Xattrs = make(map[string]string, len(hdr.Xattrs))
+	for k, v := range hdr.Xattrs {
+		if k != overlayOpaqueXattr {
+			h.Xattrs[k] = v
+		}
+	}
+	h.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+	for k, v := range hdr.PAXRecords {
+		if k != paxSchilyXattr+overlayOpaqueXattr {
+			h.PAXRecords[k] = v
+		}
+	}
+	return &h
+}
+
+// applyOpaqueDir removes the contents of the opaque directory described by
+// hdr that weren't extracted by this extraction.
+func (x *extraction) applyOpaqueDir(hdr *tar.Header) error {
+	if err := x.checkSymlinks(hdr); err != nil {
+		return err
+	}
+	if err := x.checkParents(hdr); err != nil {
+		return err
+	}
+	p := filepath.Join(x.dir, hdr.Name)
+	if !isWithinDir(x.dir, p) {
+		return &InsecurePathError{Name: hdr.Name, Dir: x.dir}
+	}
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// A non directory is replaced by the directory entry
+	if !info.IsDir() {
+		return nil
+	}
+	return x.clearDir(p)
+}
+
+// applyWhiteout removes the path hidden by the whiteout marker described by
+// hdr. An opaque marker removes the contents of its directory that weren't
+// extracted by this extraction.
+func (x *extraction) applyWhiteout(hdr *tar.Header) error {
+	if err := x.checkSymlinks(hdr); err != nil {
+		return err
+	}
+	if err := x.checkParents(hdr); err != nil {
+		return err
+	}
+	parent := filepath.Join(x.dir, filepath.Dir(hdr.Name))
+	if !isWithinDir(x.dir, parent) {
+		return &InsecurePathError{Name: hdr.Name, Dir: x.dir}
+	}
+	base := filepath.Base(hdr.Name)
+	if base == whiteoutOpaque {
+		return x.clearDir(parent)
+	}
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid whiteout %q", hdr.Name)
+	}
+	return x.removeAll(filepath.Join(parent, name))
+}
+
+// removeAll removes p and its contents. The whiteouts work on the filesystem
+// of the operating system, but a dry run records the removal instead.
+func (x *extraction) removeAll(p string) error {
+	if x.dryRun {
+		return x.fs.RemoveAll(p)
+	}
+	return os.RemoveAll(p)
+}
+
+// clearDir removes the contents of the directory p, except what has been
+// extracted by this extraction.
+func (x *extraction) clearDir(p string) error {
+	infos, err := ioutil.ReadDir(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		child := filepath.Join(p, info.Name())
+		rel, err := filepath.Rel(x.dir, child)
+		if err != nil {
+			return err
+		}
+		if _, ok := x.extracted[rootedPath(rel)]; !ok {
+			if err := x.removeAll(child); err != nil {
+				return err
+			}
+			continue
+		}
+		// A directory extracted by this extraction may have been
+		// merged with an existing one
+		if info.IsDir() {
+			if err := x.clearDir(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2016 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+)
+
+func TestExtractorWhiteouts(t *testing.T) {
+	base := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "etc/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "etc/foo.conf",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "etc/bar.conf",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "var/lib/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "var/lib/old",
+				Size: 3,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "var/lib/db/old",
+				Size: 3,
+			},
+		},
+	}
+	layer := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name: "etc/.wh.foo.conf",
+			},
+		},
+		// A whiteout for a path that doesn't exist is ignored
+		{
+			header: &tar.Header{
+				Name: "etc/.wh.missing",
+			},
+		},
+		{
+			contents: "new",
+			header: &tar.Header{
+				Name: "var/lib/db/new",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "var/lib/.wh..wh..opq",
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(), base)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := extractEntriesInto(t, NewExtractor(WithWhiteouts()), layer, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The files of the layer in the opaque directory are kept
+	expectedFiles := []*fileInfo{
+		{path: "etc", typeflag: tar.TypeDir},
+		{path: "etc/bar.conf", typeflag: tar.TypeReg, size: 3, contents: "bar"},
+		{path: "var", typeflag: tar.TypeDir},
+		{path: "var/lib", typeflag: tar.TypeDir},
+		{path: "var/lib/db", typeflag: tar.TypeDir},
+		{path: "var/lib/db/new", typeflag: tar.TypeReg, size: 3, contents: "new"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractorInsecureWhiteouts(t *testing.T) {
+	for _, name := range []string{"../.wh.foo", "dir/.wh..", "dir/.wh."} {
+		entries := []*testTarEntry{
+			{
+				header: &tar.Header{
+					Name: name,
+				},
+			},
+		}
+		tmpdir, err := extractEntries(t, NewExtractor(WithWhiteouts()), entries)
+		os.RemoveAll(tmpdir)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestExtractorOverlayOpaqueDir(t *testing.T) {
+	base := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "var/lib/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "var/lib/old",
+				Size: 3,
+			},
+		},
+	}
+	layer := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "var/lib/",
+				Typeflag: tar.TypeDir,
+				PAXRecords: map[string]string{
+					paxSchilyXattr + overlayOpaqueXattr: "y",
+				},
+			},
+		},
+		{
+			contents: "new",
+			header: &tar.Header{
+				Name: "var/lib/new",
+				Size: 3,
+			},
+		},
+	}
+
+	tmpdir, err := extractEntries(t, NewExtractor(), base)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The opaque xattr isn't restored, so this works without the
+	// privileges to set trusted.* xattrs
+	if err := extractEntriesInto(t, NewExtractor(WithWhiteouts(), WithXattrs(true)), layer, tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFiles := []*fileInfo{
+		{path: "var", typeflag: tar.TypeDir},
+		{path: "var/lib", typeflag: tar.TypeDir},
+		{path: "var/lib/new", typeflag: tar.TypeReg, size: 3, contents: "new"},
+	}
+	if err := checkExpectedFiles(tmpdir, fileInfoSliceToMap(expectedFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// Lgetxattr returns no value for missing xattrs, and an error when the
+	// trusted namespace can't be read
+	if value, _ := fileutil.Lgetxattr(filepath.Join(tmpdir, "var/lib"), overlayOpaqueXattr); value != nil {
+		t.Errorf("expected the opaque xattr not to be restored, got: %q", value)
+	}
+}
+
+func TestExtractorWhiteoutsThroughSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rkt-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.MkdirAll(filepath.Join(outside, "sub"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range []string{"passwd", "sub/shadow"} {
+		if err := ioutil.WriteFile(filepath.Join(outside, p), []byte("root"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	base := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "lib",
+				Typeflag: tar.TypeSymlink,
+				Linkname: outside,
+			},
+		},
+	}
+	for _, hdr := range []*tar.Header{
+		{Name: "lib/.wh.passwd"},
+		{Name: "lib/sub/" + whiteoutOpaque},
+		{
+			Name:     "lib/sub/",
+			Typeflag: tar.TypeDir,
+			PAXRecords: map[string]string{
+				paxSchilyXattr + overlayOpaqueXattr: "y",
+			},
+		},
+	} {
+		// The symlink is left by the base layer, extracted separately
+		tmpdir, err := extractEntries(t, NewExtractor(), base)
+		defer os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = extractEntriesInto(t, NewExtractor(WithWhiteouts()), []*testTarEntry{{header: hdr}}, tmpdir)
+		var ile *InsecureLinkError
+		if !errors.As(err, &ile) {
+			t.Errorf("%s: expected an InsecureLinkError, got: %v", hdr.Name, err)
+		} else if ile.Link != "lib" {
+			t.Errorf("%s: unexpected symlink %q", hdr.Name, ile.Link)
+		}
+	}
+	outsideFiles := []*fileInfo{
+		{path: "passwd", typeflag: tar.TypeReg, size: 4},
+		{path: "sub", typeflag: tar.TypeDir},
+		{path: "sub/shadow", typeflag: tar.TypeReg, size: 4},
+	}
+	if err := checkExpectedFiles(outside, fileInfoSliceToMap(outsideFiles)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}